@@ -0,0 +1,195 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build !windows
+// +build amd64
+// +build linux darwin
+
+package bindings
+
+// #include "waf.h"
+import "C"
+
+import (
+	"strconv"
+	"sync"
+	"unsafe"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+const (
+	// Size of the first block of an arena, doubled for every new block up to
+	// the maximum size.
+	arenaMinBlockSize = 4 << 10
+	arenaMaxBlockSize = 256 << 10
+
+	// Size of the Go array types used to access the arena memory
+	arenaMaxBytes   = 1 << 30
+	arenaMaxEntries = 1 << 24
+)
+
+// arena is a memory region of the WAF heap holding encoded WAF values. Values
+// are allocated in a few large blocks instead of one allocation per string
+// and container, and without calling the WAF to create them. The values are
+// all released at once when the arena is released, so they must not be freed
+// individually, nor passed to WAF functions taking their ownership.
+//
+// Container entries are first encoded into a Go stack before being copied
+// into the arena once the container is complete, so that they are contiguous
+// as expected by the WAF.
+type arena struct {
+	blocks []unsafe.Pointer
+	// Current block and its allocated and total sizes
+	block      unsafe.Pointer
+	used, size uintptr
+	// Stack of the entries of the containers being encoded
+	entries []WAFValue
+}
+
+// Arenas are reused to keep the Go memory of their block lists and entry
+// stacks. Their WAF memory is always released before.
+var arenaPool = sync.Pool{
+	New: func() interface{} { return new(arena) },
+}
+
+// newArena returns an empty arena which must be released once its values are
+// no longer used.
+func newArena() *arena {
+	return arenaPool.Get().(*arena)
+}
+
+// release frees the WAF memory of the arena. The arena must no longer be
+// used afterwards.
+func (a *arena) release() {
+	for i, b := range a.blocks {
+		C.pw_memFree(b)
+		a.blocks[i] = nil
+	}
+	a.blocks = a.blocks[:0]
+	a.block, a.used, a.size = nil, 0, 0
+	a.entries = a.entries[:0]
+	arenaPool.Put(a)
+}
+
+// alloc returns size bytes of the arena, aligned on 8 bytes, or nil when out
+// of memory.
+func (a *arena) alloc(size uintptr) unsafe.Pointer {
+	size = (size + 7) &^ 7
+	if a.used+size > a.size && !a.grow(size) {
+		return nil
+	}
+	p := unsafe.Pointer(uintptr(a.block) + a.used)
+	a.used += size
+	return p
+}
+
+// grow allocates a new block of at least min bytes. The rest of the current
+// block is lost.
+func (a *arena) grow(min uintptr) bool {
+	size := uintptr(arenaMinBlockSize)
+	if a.size != 0 {
+		size = a.size * 2
+		if size > arenaMaxBlockSize {
+			size = arenaMaxBlockSize
+		}
+	}
+	if size < min {
+		size = min
+	}
+	b := C.pw_memAlloc(C.uint64_t(size))
+	if b == nil {
+		return false
+	}
+	a.blocks = append(a.blocks, b)
+	a.block, a.used, a.size = b, 0, size
+	return true
+}
+
+// cstring returns the nul-terminated copy of str in the arena, truncated to
+// maxLength bytes, along with its length.
+func (a *arena) cstring(str string, maxLength int) (*C.char, int, error) {
+	if len(str) > maxLength {
+		str = str[:maxLength]
+	}
+	b := a.allocString(len(str))
+	if b == nil {
+		return nil, 0, types.ErrOutOfMemory
+	}
+	copy(b, str)
+	return (*C.char)(unsafe.Pointer(&b[0])), len(str), nil
+}
+
+// allocString returns a string of l bytes of the arena, followed by its nul
+// terminator, or nil when out of memory.
+func (a *arena) allocString(l int) []byte {
+	p := a.alloc(uintptr(l) + 1)
+	if p == nil {
+		return nil
+	}
+	b := (*[arenaMaxBytes]byte)(p)[: l+1 : l+1]
+	b[l] = 0
+	return b
+}
+
+// newWAFString returns the WAF string of str, truncated to maxLength bytes.
+func (a *arena) newWAFString(str string, maxLength int) (WAFValue, error) {
+	cstr, l, err := a.cstring(str, maxLength)
+	if err != nil {
+		return InvalidWAFValue, err
+	}
+	return newArenaWAFString(cstr, l), nil
+}
+
+// newWAFInt64 returns the WAF value of the number, which is a string as
+// created by the WAF number functions.
+func (a *arena) newWAFInt64(n int64) (WAFValue, error) {
+	var buf [20]byte
+	return a.newWAFNumber(strconv.AppendInt(buf[:0], n, 10))
+}
+
+// newWAFUInt64 is newWAFInt64 for unsigned numbers.
+func (a *arena) newWAFUInt64(n uint64) (WAFValue, error) {
+	var buf [20]byte
+	return a.newWAFNumber(strconv.AppendUint(buf[:0], n, 10))
+}
+
+func (a *arena) newWAFNumber(number []byte) (WAFValue, error) {
+	b := a.allocString(len(number))
+	if b == nil {
+		return InvalidWAFValue, types.ErrOutOfMemory
+	}
+	copy(b, number)
+	return newArenaWAFString((*C.char)(unsafe.Pointer(&b[0])), len(number)), nil
+}
+
+func newArenaWAFString(cstr *C.char, length int) WAFValue {
+	v := WAFValue{_type: wafStringType, nbEntries: C.uint64_t(length)}
+	v.setValue(uintptr(unsafe.Pointer(cstr)))
+	return v
+}
+
+// container returns the WAF value of the given type having the entries pushed
+// on the stack from index start. They are moved into the arena.
+func (a *arena) container(typ C.PW_INPUT_TYPE, start int) (WAFValue, error) {
+	entries := a.entries[start:]
+	n := len(entries)
+	v := WAFValue{_type: typ, nbEntries: C.uint64_t(n)}
+	if n > 0 {
+		p := a.alloc(uintptr(n) * unsafe.Sizeof(WAFValue{}))
+		if p == nil {
+			a.entries = a.entries[:start]
+			return InvalidWAFValue, types.ErrOutOfMemory
+		}
+		copy((*[arenaMaxEntries]WAFValue)(p)[:n:n], entries)
+		v.setValue(uintptr(p))
+	}
+	a.entries = a.entries[:start]
+	return v, nil
+}
+
+// setValue sets the value union of the WAF value to the given pointer.
+func (v *WAFValue) setValue(p uintptr) {
+	*(*uintptr)(unsafe.Pointer(&v.anon0)) = p
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build cgo
+// +build !windows
+// +build amd64
+// +build linux darwin
+
+package bindings
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArena(t *testing.T) {
+	t.Run("encoding", func(t *testing.T) {
+		config := types.Config{
+			MaxValueDepth:   10,
+			MaxStringLength: 32,
+			MaxArrayLength:  50,
+		}.WithDefaults()
+
+		for name, data := range fastPathTestCases() {
+			data := data
+			t.Run(name, func(t *testing.T) {
+				e := newEncoder(config)
+				expectedV, expectedNbValues, expectedStats, err := e.encode(data)
+				require.NoError(t, err)
+				defer expectedV.free()
+
+				a := newArena()
+				defer a.release()
+				v, nbValues, stats, err := e.encodeArena(data, a)
+				require.NoError(t, err)
+
+				require.Equal(t, decodeValue(t, expectedV), decodeValue(t, v))
+				require.Equal(t, expectedNbValues, nbValues)
+				require.ElementsMatch(t, expectedStats.Events, stats.Events)
+				expectedStats.Events, stats.Events = nil, nil
+				require.Equal(t, expectedStats, stats)
+				// The entry stack is empty once done
+				require.Empty(t, a.entries)
+			})
+		}
+	})
+
+	t.Run("ignored values", func(t *testing.T) {
+		e := newEncoder(types.Config{MaxValueDepth: 3}.WithDefaults())
+		a := newArena()
+		defer a.release()
+		v, _, _, err := e.encodeArena(types.DataSet{
+			"a": []interface{}{"b", func() {}, []interface{}{[]string{"too deep"}, "c"}},
+		}, a)
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{
+			"a": []interface{}{"b", []interface{}{"c"}},
+		}, decodeValue(t, v))
+		require.Empty(t, a.entries)
+	})
+
+	t.Run("blocks", func(t *testing.T) {
+		a := newArena()
+		// Strings larger than a block get their own block
+		large := strings.Repeat("a", 2*arenaMaxBlockSize)
+		var values []WAFValue
+		for _, str := range []string{"small", large, "small"} {
+			v, err := a.newWAFString(str, len(str))
+			require.NoError(t, err)
+			values = append(values, v)
+		}
+		require.Len(t, a.blocks, 3)
+		require.Equal(t, "small", decodeValue(t, values[0]))
+		require.Equal(t, large, decodeValue(t, values[1]))
+		require.Equal(t, "small", decodeValue(t, values[2]))
+
+		a.release()
+		require.Empty(t, a.blocks)
+		require.Zero(t, a.size)
+	})
+}
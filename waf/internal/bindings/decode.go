@@ -0,0 +1,200 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build !windows
+// +build amd64
+// +build linux darwin
+
+package bindings
+
+// #include "waf.h"
+//
+// static const char* pw_getStringValue(const PWArgs* v) { return v->stringValue; }
+// static int64_t pw_getIntValue(const PWArgs* v) { return v->intValue; }
+// static uint64_t pw_getUintValue(const PWArgs* v) { return v->uintValue; }
+// static const PWArgs* pw_getArrayValue(const PWArgs* v) { return v->array; }
+import "C"
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// Decode returns the Go value of the WAF value, as it is passed to the WAF:
+// strings are decoded as string, signed and unsigned numbers as int64 and
+// uint64, arrays as []interface{} and maps as map[string]interface{}. The
+// last entry is kept when map keys are duplicated, which is possible when
+// they are truncated: Dump writes every entry. An error is returned when the
+// value or one of its children is invalid.
+func Decode(v WAFValue) (interface{}, error) {
+	return decode(&v, nil)
+}
+
+func decode(v *WAFValue, path []string) (interface{}, error) {
+	switch v._type {
+	case wafStringType:
+		if err := v.checkPointer(path); err != nil {
+			return nil, err
+		}
+		return v.string(), nil
+	case wafSignedNumberType:
+		return int64(C.pw_getIntValue((*C.PWArgs)(v))), nil
+	case wafUnsignedNumberType:
+		return uint64(C.pw_getUintValue((*C.PWArgs)(v))), nil
+	case wafArrayType:
+		if err := v.checkPointer(path); err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, 0, v.nbEntries)
+		for i, e := range v.entries() {
+			d, err := decode(&e, append(path, strconv.Itoa(i)))
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, d)
+		}
+		return a, nil
+	case wafMapType:
+		if err := v.checkPointer(path); err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, v.nbEntries)
+		for _, e := range v.entries() {
+			k := e.key()
+			d, err := decode(&e, append(path, k))
+			if err != nil {
+				return nil, err
+			}
+			m[k] = d
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("invalid waf value type %d at %s", int(v._type), keyPath(path))
+	}
+}
+
+// Dump writes the human-readable representation of the WAF value, along with
+// the type of every value and the length of containers, for example:
+//
+//	map(2) {
+//	  "k1": array(1) [
+//	    "v1"
+//	  ]
+//	  "k2": uint(1)
+//	}
+func Dump(w io.Writer, v WAFValue) error {
+	bw := bufio.NewWriter(w)
+	if err := dump(bw, &v, 0, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func dump(w *bufio.Writer, v *WAFValue, indent int, path []string) error {
+	switch v._type {
+	case wafStringType:
+		if err := v.checkPointer(path); err != nil {
+			return err
+		}
+		w.WriteString(strconv.Quote(v.string()))
+	case wafSignedNumberType:
+		fmt.Fprintf(w, "int(%d)", int64(C.pw_getIntValue((*C.PWArgs)(v))))
+	case wafUnsignedNumberType:
+		fmt.Fprintf(w, "uint(%d)", uint64(C.pw_getUintValue((*C.PWArgs)(v))))
+	case wafArrayType, wafMapType:
+		if err := v.checkPointer(path); err != nil {
+			return err
+		}
+		isMap := v._type == wafMapType
+		prefix, suffix := "array(%d) [", "]"
+		if isMap {
+			prefix, suffix = "map(%d) {", "}"
+		}
+		fmt.Fprintf(w, prefix, int(v.nbEntries))
+		entries := v.entries()
+		for i, e := range entries {
+			w.WriteString("\n")
+			w.WriteString(strings.Repeat("  ", indent+1))
+			k := strconv.Itoa(i)
+			if isMap {
+				k = e.key()
+				w.WriteString(strconv.Quote(k))
+				w.WriteString(": ")
+			}
+			if err := dump(w, &e, indent+1, append(path, k)); err != nil {
+				return err
+			}
+		}
+		if len(entries) > 0 {
+			w.WriteString("\n")
+			w.WriteString(strings.Repeat("  ", indent))
+		}
+		w.WriteString(suffix)
+	default:
+		return fmt.Errorf("invalid waf value type %d at %s", int(v._type), keyPath(path))
+	}
+	if indent == 0 {
+		w.WriteString("\n")
+	}
+	return nil
+}
+
+// DumpDataSet writes the human-readable representation of the WAF value of
+// the data set, as encoded by the rules having the given configuration, in
+// order to debug what the WAF receives.
+func DumpDataSet(w io.Writer, data types.DataSet, config types.Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	v, _, _, err := newEncoder(config.WithDefaults()).encode(data)
+	if err != nil {
+		return err
+	}
+	defer v.free()
+	return Dump(w, v)
+}
+
+// checkPointer returns an error when the value has entries but no pointer to
+// them.
+func (v *WAFValue) checkPointer(path []string) error {
+	if v.nbEntries > 0 && C.pw_getArrayValue((*C.PWArgs)(v)) == nil {
+		return fmt.Errorf("nil waf value pointer having %d entries at %s", uint64(v.nbEntries), keyPath(path))
+	}
+	return nil
+}
+
+func (v *WAFValue) string() string {
+	return C.GoStringN(C.pw_getStringValue((*C.PWArgs)(v)), C.int(v.nbEntries))
+}
+
+func (v *WAFValue) key() string {
+	return C.GoStringN(v.parameterName, C.int(v.parameterNameLength))
+}
+
+// entries returns the entries of the array or map value.
+func (v *WAFValue) entries() []WAFValue {
+	n := int(v.nbEntries)
+	if n == 0 {
+		return nil
+	}
+	array := unsafe.Pointer(C.pw_getArrayValue((*C.PWArgs)(v)))
+	entries := make([]WAFValue, n)
+	for i := range entries {
+		entries[i] = *(*WAFValue)(unsafe.Pointer(uintptr(array) + uintptr(i)*unsafe.Sizeof(WAFValue{})))
+	}
+	return entries
+}
+
+func keyPath(path []string) string {
+	if len(path) == 0 {
+		return "the root"
+	}
+	return strconv.Quote(strings.Join(path, "."))
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build cgo
+// +build !windows
+// +build amd64
+// +build linux darwin
+
+package bindings
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeValue returns the decoded WAF value, which is expected to be valid.
+func decodeValue(t testing.TB, v WAFValue) interface{} {
+	d, err := Decode(v)
+	require.NoError(t, err)
+	return d
+}
+
+func TestDecode(t *testing.T) {
+	t.Run("invalid value", func(t *testing.T) {
+		_, err := Decode(InvalidWAFValue)
+		require.Error(t, err)
+		require.Error(t, Dump(&bytes.Buffer{}, InvalidWAFValue))
+	})
+
+	t.Run("values", func(t *testing.T) {
+		e := newEncoder(types.Config{MaxStringLength: 2}.WithDefaults())
+		v, _, _, err := e.encode(types.DataSet{
+			"a":   []interface{}{"abc", 1, -1.4, true, []string{}, map[string]string{}},
+			"abc": map[string]interface{}{"b": uint8(2)},
+		})
+		require.NoError(t, err)
+		defer v.free()
+
+		// The map keys are truncated too
+		require.Equal(t, map[string]interface{}{
+			"a":  []interface{}{"ab", "1", "-1", "1", []interface{}{}, map[string]interface{}{}},
+			"ab": map[string]interface{}{"b": "2"},
+		}, decodeValue(t, v))
+	})
+}
+
+func TestDump(t *testing.T) {
+	e := newEncoder(types.DefaultConfig())
+	v, _, _, err := e.encode(types.DataSet{
+		"a": []interface{}{"b\n", 1, []string{}},
+	})
+	require.NoError(t, err)
+	defer v.free()
+
+	var buf bytes.Buffer
+	require.NoError(t, Dump(&buf, v))
+	require.Equal(t, `map(1) {
+  "a": array(3) [
+    "b\n"
+    "1"
+    array(0) []
+  ]
+}
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, DumpDataSet(&buf, types.DataSet{"a": 1}, types.Config{}))
+	require.Equal(t, "map(1) {\n  \"a\": \"1\"\n}\n", buf.String())
+
+	require.Error(t, DumpDataSet(&buf, types.DataSet{}, types.Config{MaxValueDepth: -1}))
+}
+
+// TestEncodeDecode checks that decoding random encoded values returns the
+// expected normalized values: numbers are strings, and the values beyond the
+// limits are truncated.
+func TestEncodeDecode(t *testing.T) {
+	config := types.Config{
+		MaxValueDepth:   4,
+		MaxStringLength: 8,
+		MaxArrayLength:  4,
+		MaxMapLength:    4,
+	}.WithDefaults()
+	g := valueGenerator{rnd: rand.New(rand.NewSource(1)), config: config}
+
+	for i := 0; i < 200; i++ {
+		data, expected := g.dataSet()
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			for _, reflectOnly := range []bool{false, true} {
+				e := newEncoder(config)
+				e.ReflectOnly = reflectOnly
+				v, _, _, err := e.encode(data)
+				require.NoError(t, err)
+				require.Equal(t, expected, decodeValue(t, v))
+				v.free()
+
+				a := newArena()
+				v, _, _, err = e.encodeArena(data, a)
+				require.NoError(t, err)
+				require.Equal(t, expected, decodeValue(t, v))
+				a.release()
+			}
+		})
+	}
+}
+
+// valueGenerator generates random values along with their expected decoded
+// value.
+type valueGenerator struct {
+	rnd    *rand.Rand
+	config types.Config
+}
+
+func (g valueGenerator) dataSet() (types.DataSet, interface{}) {
+	data, expected := g.stringMap(1, func(depth int) (interface{}, interface{}) {
+		return g.value(depth)
+	})
+	return types.DataSet(data), expected
+}
+
+// value returns a random value at the given depth. Containers are only
+// generated within the maximum depth.
+func (g valueGenerator) value(depth int) (interface{}, interface{}) {
+	kinds := 6
+	if depth < g.config.MaxValueDepth {
+		kinds = 10
+	}
+	switch g.rnd.Intn(kinds) {
+	case 0, 1:
+		s := g.string(2 * g.config.MaxStringLength)
+		return s, s[:min(len(s), g.config.MaxStringLength)]
+	case 2:
+		n := g.rnd.Int63() - math.MaxInt64/2
+		return n, strconv.FormatInt(n, 10)
+	case 3:
+		n := g.rnd.Uint64()
+		return n, strconv.FormatUint(n, 10)
+	case 4:
+		b := g.rnd.Intn(2) == 1
+		if b {
+			return b, "1"
+		}
+		return b, "0"
+	case 5:
+		n := g.rnd.Int31()
+		return float64(n), strconv.Itoa(int(n))
+	case 6:
+		return g.interfaceArray(depth + 1)
+	case 7:
+		return g.stringArray()
+	case 8:
+		m, expected := g.stringMap(depth+1, func(int) (interface{}, interface{}) {
+			s := g.string(2 * g.config.MaxStringLength)
+			return s, s[:min(len(s), g.config.MaxStringLength)]
+		})
+		stringMap := make(map[string]string, len(m))
+		for k, v := range m {
+			stringMap[k] = v.(string)
+		}
+		return stringMap, expected
+	default:
+		return g.stringMap(depth+1, g.value)
+	}
+}
+
+func (g valueGenerator) interfaceArray(depth int) ([]interface{}, interface{}) {
+	n := g.rnd.Intn(2 * g.config.MaxArrayLength)
+	a := make([]interface{}, n)
+	expected := make([]interface{}, 0, n)
+	for i := range a {
+		v, e := g.value(depth)
+		a[i] = v
+		if i < g.config.MaxArrayLength {
+			expected = append(expected, e)
+		}
+	}
+	return a, expected
+}
+
+func (g valueGenerator) stringArray() ([]string, interface{}) {
+	n := g.rnd.Intn(2 * g.config.MaxArrayLength)
+	a := make([]string, n)
+	expected := make([]interface{}, 0, n)
+	for i := range a {
+		a[i] = g.string(2 * g.config.MaxStringLength)
+		if i < g.config.MaxArrayLength {
+			expected = append(expected, a[i][:min(len(a[i]), g.config.MaxStringLength)])
+		}
+	}
+	return a, expected
+}
+
+// stringMap returns a map having unique keys shorter than the maximum string
+// length, so that they are not truncated. The first keys in lexicographical
+// order are kept when the map is truncated.
+func (g valueGenerator) stringMap(depth int, value func(int) (interface{}, interface{})) (map[string]interface{}, interface{}) {
+	n := g.rnd.Intn(2 * g.config.MaxMapLength)
+	m := make(map[string]interface{}, n)
+	expectedValues := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("k%d", i)
+		m[k], expectedValues[k] = value(depth)
+	}
+	keys := make([]string, 0, n)
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	expected := make(map[string]interface{}, n)
+	for _, k := range keys[:min(n, g.config.MaxMapLength)] {
+		expected[k] = expectedValues[k]
+	}
+	return m, expected
+}
+
+func (g valueGenerator) string(maxLength int) string {
+	b := make([]byte, g.rnd.Intn(maxLength+1))
+	g.rnd.Read(b)
+	return string(b)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
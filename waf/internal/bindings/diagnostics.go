@@ -0,0 +1,102 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build !windows
+// +build amd64
+// +build linux darwin
+
+package bindings
+
+// #include <stdlib.h>
+// #include "waf.h"
+import "C"
+
+import (
+	"encoding/json"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// goDiagnostics decodes the error report populated by `pw_initH`.
+func goDiagnostics(report *C.char) types.Diagnostics {
+	if report == nil {
+		return nil
+	}
+	return decodeDiagnostics(C.GoString(report))
+}
+
+// diagnosticEntry is an entry of the error report of `pw_initH`, which is a
+// JSON array of objects such as:
+//
+//	[
+//	  { "code": 4, "message": "duplicate rule", "rule_id": "crs-913-110" },
+//	  { "code": 6, "message": "invalid step", "flow": "arachni", "step": "start" }
+//	]
+//
+// where the code is a `PW_DIAG_CODE` value and the other fields are optional.
+type diagnosticEntry struct {
+	Code     *int   `json:"code"`
+	Message  string `json:"message"`
+	RuleID   string `json:"rule_id"`
+	FlowName string `json:"flow"`
+	StepID   string `json:"step"`
+}
+
+// decodeDiagnostics decodes the given error report. A report which is not in
+// the expected format is returned as a single entry holding the raw text.
+func decodeDiagnostics(report string) types.Diagnostics {
+	if report == "" {
+		return nil
+	}
+	var entries []diagnosticEntry
+	if err := json.Unmarshal([]byte(report), &entries); err != nil {
+		return types.Diagnostics{{Code: types.DiagUnknown, Message: report}}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	diags := make(types.Diagnostics, 0, len(entries))
+	for _, entry := range entries {
+		diags = append(diags, types.Diagnostic{
+			Code:     goDiagnosticCode(entry.Code),
+			Message:  entry.Message,
+			RuleID:   entry.RuleID,
+			FlowName: entry.FlowName,
+			StepID:   entry.StepID,
+		})
+	}
+	return diags
+}
+
+func goDiagnosticCode(code *int) types.DiagnosticCode {
+	if code == nil {
+		return types.DiagUnknown
+	}
+	switch C.PW_DIAG_CODE(*code) {
+	case C.PWD_PARSING_JSON:
+		return types.DiagParsingJSON
+	case C.PWD_PARSING_RULE:
+		return types.DiagParsingRule
+	case C.PWD_PARSING_RULE_FILTER:
+		return types.DiagParsingRuleFilter
+	case C.PWD_OPERATOR_VALUE:
+		return types.DiagOperatorValue
+	case C.PWD_DUPLICATE_RULE:
+		return types.DiagDuplicateRule
+	case C.PWD_PARSING_FLOW:
+		return types.DiagParsingFlow
+	case C.PWD_PARSING_FLOW_STEP:
+		return types.DiagParsingFlowStep
+	case C.PWD_MEANINGLESS_STEP:
+		return types.DiagMeaninglessStep
+	case C.PWD_DUPLICATE_FLOW:
+		return types.DiagDuplicateFlow
+	case C.PWD_DUPLICATE_FLOW_STEP:
+		return types.DiagDuplicateFlowStep
+	case C.PWD_STEP_HAS_INVALID_RULE:
+		return types.DiagStepHasInvalidRule
+	default:
+		return types.DiagUnknown
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build cgo
+// +build !windows
+// +build amd64
+// +build linux darwin
+
+package bindings
+
+import (
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeDiagnostics(t *testing.T) {
+	for _, tc := range []struct {
+		Name     string
+		Report   string
+		Expected types.Diagnostics
+	}{
+		{
+			Name:   "duplicate rule",
+			Report: `[{"code":4,"message":"duplicate rule","rule_id":"crs-913-110"}]`,
+			Expected: types.Diagnostics{
+				{Code: types.DiagDuplicateRule, Message: "duplicate rule", RuleID: "crs-913-110"},
+			},
+		},
+		{
+			Name:   "unknown operator",
+			Report: `[{"code":1,"message":"unknown operator @oops","rule_id":"crs-913-110"},{"code":10,"message":"invalid rule","rule_id":"crs-913-110","flow":"arachni","step":"start"}]`,
+			Expected: types.Diagnostics{
+				{Code: types.DiagParsingRule, Message: "unknown operator @oops", RuleID: "crs-913-110"},
+				{Code: types.DiagStepHasInvalidRule, Message: "invalid rule", RuleID: "crs-913-110", FlowName: "arachni", StepID: "start"},
+			},
+		},
+		{
+			Name:   "unknown code",
+			Report: `[{"code":42,"message":"oops"},{"message":"no code"}]`,
+			Expected: types.Diagnostics{
+				{Code: types.DiagUnknown, Message: "oops"},
+				{Code: types.DiagUnknown, Message: "no code"},
+			},
+		},
+		{
+			Name:   "malformed",
+			Report: `{ oops`,
+			Expected: types.Diagnostics{
+				{Code: types.DiagUnknown, Message: `{ oops`},
+			},
+		},
+		{
+			Name:     "empty",
+			Report:   ``,
+			Expected: nil,
+		},
+		{
+			Name:     "empty array",
+			Report:   `[]`,
+			Expected: nil,
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			require.Equal(t, tc.Expected, decodeDiagnostics(tc.Report))
+		})
+	}
+}
@@ -13,10 +13,8 @@ import "C"
 
 import (
 	"errors"
-	"math"
-	"reflect"
-	"unicode"
 
+	"github.com/sqreen/go-libsqreen/waf/internal/marshal"
 	"github.com/sqreen/go-libsqreen/waf/types"
 )
 
@@ -29,197 +27,182 @@ const (
 	wafMapType            = C.PWI_MAP
 )
 
+// Errors of the values which are not encoded.
 var (
-	ErrMaxDepth         = errors.New("max depth reached")
-	ErrUnsupportedValue = errors.New("unsupported value")
+	ErrMaxDepth         = marshal.ErrMaxDepth
+	ErrUnsupportedValue = marshal.ErrUnsupportedValue
+	ErrCycle            = marshal.ErrCycle
 )
 
-type Encoder struct {
-	MaxValueDepth   int
-	MaxStringLength int
-	MaxArrayLength  int
-	MaxMapLength    int
+// Encoder encodes Go values into WAF values with the limits and rules of
+// marshal.Encoder.
+type Encoder marshal.Encoder
+
+// newEncoder returns the encoder having the limits of the given configuration,
+// which is expected to be valid and have its default values set.
+func newEncoder(config types.Config) Encoder {
+	return Encoder(marshal.NewEncoder(config))
 }
 
-func (e *Encoder) marshalWAFValue(data types.DataSet) (WAFValue, error) {
-	return e.marshalWAFValueRec(reflect.ValueOf(data), 0)
+// encode marshals the data set. The encoding accounting is specific to this
+// call and concurrent calls are safe.
+func (e Encoder) encode(data types.DataSet) (v WAFValue, nbValues int, stats types.EncodeStats, err error) {
+	return e.marshal(data, nil)
 }
 
-func (e *Encoder) marshalWAFValueRec(data reflect.Value, depth int) (v WAFValue, err error) {
-	v = InvalidWAFValue
+// encodeArena is encode with the values allocated in the given arena. The
+// returned value is released with the arena and must not be freed.
+func (e Encoder) encodeArena(data types.DataSet, a *arena) (v WAFValue, nbValues int, stats types.EncodeStats, err error) {
+	return e.marshal(data, a)
+}
 
-	if depth > e.MaxValueDepth {
-		// Stop traversing and keep v to its current zero value.
-		return InvalidWAFValue, ErrMaxDepth
+// marshal encodes the Go value, allocating the WAF values in the arena when
+// not nil.
+func (e Encoder) marshal(data interface{}, a *arena) (v WAFValue, nbValues int, stats types.EncodeStats, err error) {
+	s := wafSink{arena: a}
+	nbValues, stats, err = marshal.Encoder(e).Encode(data, &s)
+	if err != nil {
+		return InvalidWAFValue, nbValues, stats, err
 	}
+	return s.v, nbValues, stats, nil
+}
 
-	switch kind := data.Kind(); kind {
-	default:
-		return InvalidWAFValue, ErrUnsupportedValue
-
-	case reflect.Bool:
-		var b uint64
-		if data.Bool() {
-			b = 1
-		}
-		return newWAFUInt64(b), nil
-
-	case reflect.Struct:
-		return e.marshalWAFStruct(data, depth+1)
-
-	case reflect.Ptr, reflect.Interface:
-		// Not accounted in the depth as it has no impact on the value
-		// representation
-		return e.marshalWAFValueRec(data.Elem(), depth)
-
-	case reflect.String:
-		return newWAFString(data.String(), e.MaxStringLength)
-
-	case reflect.Map:
-		return e.marshalWAFMap(data, depth+1)
-
-	case reflect.Array, reflect.Slice:
-		return e.marshalWAFArray(data, depth+1)
-
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return newWAFInt64(data.Int()), nil
+// Static assert that the sink implements its interface
+var _ marshal.Sink = (*wafSink)(nil)
+
+// wafSink builds the WAF values emitted by the encoder, which are allocated
+// individually, or in the arena when not nil.
+type wafSink struct {
+	arena *arena
+	// Containers being built, the innermost last
+	containers []wafContainer
+	// The encoded value
+	v WAFValue
+}
 
-	case reflect.Float32, reflect.Float64:
-		return newWAFInt64(int64(math.Round(data.Float()))), nil
+// wafContainer is a WAF array or map being encoded.
+type wafContainer struct {
+	// WAF value the entries are added to, or only its type when encoding into
+	// an arena.
+	v WAFValue
+	// Index of the first entry in the arena entry stack.
+	start int
+}
 
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
-		reflect.Uint64:
-		return newWAFUInt64(data.Uint()), nil
+func (s *wafSink) String(key, str string) error {
+	var (
+		v   WAFValue
+		err error
+	)
+	if s.arena != nil {
+		v, err = s.arena.newWAFString(str, len(str))
+	} else {
+		v, err = newWAFString(str, len(str))
 	}
+	if err != nil {
+		return err
+	}
+	return s.add(key, &v)
 }
 
-func (e *Encoder) marshalWAFStruct(data reflect.Value, depth int) (v WAFValue, err error) {
-	if depth > e.MaxValueDepth {
-		return InvalidWAFValue, ErrMaxDepth
+func (s *wafSink) Int(key string, n int64) error {
+	if s.arena == nil {
+		v := newWAFInt64(n)
+		return s.add(key, &v)
 	}
-
-	m := newWAFMap()
-	defer func() {
-		if err != nil {
-			m.free()
-		}
-	}()
-
-	dataT := data.Type()
-	nbFields := dataT.NumField()
-	for length, i := 0, 0; length < e.MaxMapLength && i < nbFields; i++ {
-		field := dataT.Field(i)
-		// Skip private fields
-		fName := field.Name
-		if len(fName) < 1 || unicode.IsLower(rune(fName[0])) {
-			continue
-		}
-
-		v, err := e.marshalWAFValueRec(data.Field(i), depth)
-		if err != nil {
-			if isIgnoredValueError(err) {
-				continue
-			}
-			return v, err
-		}
-
-		if err := addToMap(&m, fName, &v, e.MaxStringLength); err != nil {
-			return InvalidWAFValue, err
-		}
-
-		length++
+	v, err := s.arena.newWAFInt64(n)
+	if err != nil {
+		return err
 	}
-
-	return m, nil
+	return s.add(key, &v)
 }
 
-func isIgnoredValueError(err error) bool {
-	return err == ErrUnsupportedValue || err == ErrMaxDepth
+func (s *wafSink) Uint(key string, n uint64) error {
+	if s.arena == nil {
+		v := newWAFUInt64(n)
+		return s.add(key, &v)
+	}
+	v, err := s.arena.newWAFUInt64(n)
+	if err != nil {
+		return err
+	}
+	return s.add(key, &v)
 }
 
-func (e *Encoder) marshalWAFMap(data reflect.Value, depth int) (v WAFValue, err error) {
-	if depth > e.MaxValueDepth {
-		return InvalidWAFValue, ErrMaxDepth
+func (s *wafSink) Start(isMap bool) {
+	typ := C.PW_INPUT_TYPE(wafArrayType)
+	if isMap {
+		typ = wafMapType
 	}
-
-	m := newWAFMap()
-	defer func() {
-		if err != nil {
-			m.free()
-		}
-	}()
-
-	// Marshal map entries
-	for length, iter := 0, data.MapRange(); length < e.MaxMapLength && iter.Next(); {
-		key, ok := getString(iter.Key())
-		if !ok {
-			continue
-		}
-		v, err := e.marshalWAFValueRec(iter.Value(), depth)
-		if err != nil {
-			if isIgnoredValueError(err) {
-				continue
-			}
-			return v, err
-		}
-
-		if err := addToMap(&m, key, &v, e.MaxStringLength); err != nil {
-			return InvalidWAFValue, err
-		}
-
-		length++
+	if s.arena != nil {
+		s.containers = append(s.containers, wafContainer{v: WAFValue{_type: typ}, start: len(s.arena.entries)})
+		return
 	}
-
-	return m, nil
+	c := wafContainer{v: newWAFArray()}
+	if isMap {
+		c.v = newWAFMap()
+	}
+	s.containers = append(s.containers, c)
 }
 
-func getString(v reflect.Value) (string, bool) {
-	for {
-		switch v.Kind() {
-		default:
-			return "", false
-		case reflect.String:
-			return v.String(), true
-		case reflect.Ptr, reflect.Interface:
-			if v.IsNil() {
-				return "", false
-			}
-			v = v.Elem()
-		}
+func (s *wafSink) End(key string) error {
+	c := s.pop()
+	if s.arena == nil {
+		return s.add(key, &c.v)
+	}
+	v, err := s.arena.container(c.v._type, c.start)
+	if err != nil {
+		return err
 	}
+	return s.add(key, &v)
 }
 
-func (e *Encoder) marshalWAFArray(data reflect.Value, depth int) (v WAFValue, err error) {
-	if depth > e.MaxValueDepth {
-		return InvalidWAFValue, ErrMaxDepth
+func (s *wafSink) Discard() {
+	c := s.pop()
+	if s.arena != nil {
+		// The memory is released with the arena
+		s.arena.entries = s.arena.entries[:c.start]
+		return
 	}
+	c.v.free()
+}
 
-	a := newWAFArray()
-	defer func() {
-		if err != nil {
-			a.free()
-		}
-	}()
-
-	// Profiling shows `data.Len()` is called every loop if it is
-	// used in the loop condition.
-	l := data.Len()
-	for length, i := 0, 0; length < e.MaxArrayLength && i < l; i++ {
-		v, err := e.marshalWAFValueRec(data.Index(i), depth)
-		if err != nil {
-			if isIgnoredValueError(err) {
-				continue
-			}
-			return v, err
-		}
+func (s *wafSink) pop() wafContainer {
+	last := len(s.containers) - 1
+	c := s.containers[last]
+	s.containers = s.containers[:last]
+	return c
+}
 
-		if err := addToArray(&a, &v); err != nil {
-			return InvalidWAFValue, err
+// add the value to the innermost container, or set it as the encoded value
+// when there is none. The value is freed when it cannot be added.
+func (s *wafSink) add(key string, v *WAFValue) error {
+	if len(s.containers) == 0 {
+		s.v = *v
+		return nil
+	}
+	c := &s.containers[len(s.containers)-1]
+	if s.arena != nil {
+		if c.v._type == wafMapType {
+			k, l, err := s.arena.cstring(key, len(key))
+			if err != nil {
+				return err
+			}
+			v.parameterName, v.parameterNameLength = k, C.uint64_t(l)
 		}
-
-		length++
+		s.arena.entries = append(s.arena.entries, *v)
+		return nil
+	}
+	var err error
+	if c.v._type == wafMapType {
+		err = addToMap(&c.v, key, v, len(key))
+	} else {
+		err = addToArray(&c.v, v)
+	}
+	if err != nil {
+		v.free()
 	}
-	return a, nil
+	return err
 }
 
 type WAFValue C.PWArgs
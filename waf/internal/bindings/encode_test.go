@@ -0,0 +1,142 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build cgo
+// +build !windows
+// +build amd64
+// +build linux darwin
+
+package bindings
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+// fastPathTestCases are data sets of the types having a fast path.
+func fastPathTestCases() map[string]types.DataSet {
+	var jsonBody interface{}
+	if err := json.Unmarshal([]byte(`{
+  "user": { "name": "Arachni", "admin": true, "age": 33.5, "tags": ["a", "b", null] },
+  "items": [1, 2.25, "three", { "four": [4] }, [[[[[[[[[[[[["deep"]]]]]]]]]]]]]],
+  "empty": {}
+}`), &jsonBody); err != nil {
+		panic(err)
+	}
+	long := strings.Repeat("a", 64)
+	self := map[string]interface{}{"a": "b"}
+	self["self"] = self
+	selfArray := []interface{}{"a", nil}
+	selfArray[1] = selfArray
+	shared := map[string]interface{}{"shared": []interface{}{"a"}}
+	manyHeaders := http.Header{}
+	manyValues := map[string]interface{}{}
+	for i := 0; i < 2*types.DefaultMaxMapLength; i++ {
+		manyHeaders.Set(fmt.Sprintf("X-Header-%d", i), "value")
+		manyValues[fmt.Sprint(i)] = i
+	}
+
+	return map[string]types.DataSet{
+		"headers": {
+			"server.request.headers.no_cookies": http.Header{
+				"User-Agent":   []string{"Arachni"},
+				"Accept":       []string{"text/html", "application/json"},
+				"X-Long-Value": []string{long},
+				long:           []string{"long key"},
+				"X-Many":       make([]string, 100),
+			},
+		},
+		"query": {
+			"server.request.query": url.Values{"q": []string{"1 UNION SELECT"}, "id": nil},
+			"server.request.uri":   "/?q=1 UNION SELECT",
+		},
+		"json": {
+			"server.request.body": jsonBody,
+		},
+		"mixed": {
+			"strings":    []string{"a", "b"},
+			"map":        map[string]string{"k": "v"},
+			"map arrays": map[string][]string{"k": {"v"}},
+			"numbers":    []interface{}{1, 2.5, true, false, nil, func() {}},
+			"nested":     map[string]interface{}{"headers": http.Header{"K": {"v"}}, "struct": struct{ A string }{"a"}},
+		},
+		"truncated": {
+			"server.request.headers.no_cookies": manyHeaders,
+			"values":                            manyValues,
+		},
+		"cycles": {
+			"map":    self,
+			"array":  selfArray,
+			"shared": []interface{}{shared, shared, &shared},
+		},
+	}
+}
+
+func TestMarshalFastPath(t *testing.T) {
+	config := types.Config{
+		MaxValueDepth:   10,
+		MaxStringLength: 32,
+		MaxArrayLength:  50,
+	}.WithDefaults()
+
+	for name, data := range fastPathTestCases() {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			fast := newEncoder(config)
+			v, nbValues, stats, err := fast.encode(data)
+			require.NoError(t, err)
+			defer v.free()
+
+			reflective := newEncoder(config)
+			reflective.ReflectOnly = true
+			expectedV, expectedNbValues, expectedStats, err := reflective.encode(data)
+			require.NoError(t, err)
+			defer expectedV.free()
+
+			require.Equal(t, decodeValue(t, expectedV), decodeValue(t, v))
+			require.Equal(t, expectedNbValues, nbValues)
+			// Map entries are encoded in random order
+			require.ElementsMatch(t, expectedStats.Events, stats.Events)
+			expectedStats.Events, stats.Events = nil, nil
+			require.Equal(t, expectedStats, stats)
+		})
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for name, data := range fastPathTestCases() {
+		data := data
+		for _, mode := range []string{"reflect", "fast", "arena"} {
+			mode := mode
+			b.Run(name+"/"+mode, func(b *testing.B) {
+				e := newEncoder(types.DefaultConfig())
+				e.ReflectOnly = mode == "reflect"
+				b.ReportAllocs()
+				b.ResetTimer()
+				for n := 0; n < b.N; n++ {
+					if mode == "arena" {
+						a := newArena()
+						if _, _, _, err := e.encodeArena(data, a); err != nil {
+							b.Fatal(err)
+						}
+						a.release()
+						continue
+					}
+					v, _, _, err := e.encode(data)
+					if err != nil {
+						b.Fatal(err)
+					}
+					v.free()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build !windows
+// +build amd64
+// +build linux darwin
+
+package bindings
+
+// #include "waf.h"
+// extern void goLogCallback(PW_LOG_LEVEL level, char* function, char* file, int line, char* message, uint64_t message_len);
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// Serializes the logger setups.
+var logSetupMu sync.Mutex
+
+// SetLogger sets the logger the WAF messages of at least the given level are
+// relayed to. A nil logger disables the logging. The logger is called from a
+// dedicated goroutine so that it cannot block the WAF: messages are dropped
+// when it is too slow to consume them (cf. DroppedLogs()).
+func SetLogger(logger types.Logger, minLevel types.LogLevel) error {
+	logSetupMu.Lock()
+	defer logSetupMu.Unlock()
+
+	if logger == nil {
+		if !C.pw_setupLogging(nil, C.PWL_TRACE) {
+			return errors.New("could not disable the waf logging")
+		}
+		if old := swapLogSink(nil); old != nil {
+			old.stop()
+		}
+		return nil
+	}
+
+	level, err := cLogLevel(minLevel)
+	if err != nil {
+		return err
+	}
+
+	sink := newLogSink(logger)
+	old := swapLogSink(sink)
+	if !C.pw_setupLogging(C.pw_logging_cb_t(C.goLogCallback), level) {
+		swapLogSink(old)
+		sink.stop()
+		return errors.New("could not setup the waf logging")
+	}
+	if old != nil {
+		old.stop()
+	}
+	return nil
+}
+
+//export goLogCallback
+func goLogCallback(level C.PW_LOG_LEVEL, function *C.char, file *C.char, line C.int, message *C.char, messageLen C.uint64_t) {
+	logToSink(logRecord{
+		level:    goLogLevel(level),
+		function: C.GoString(function),
+		file:     C.GoString(file),
+		line:     int(line),
+		message:  C.GoStringN(message, C.int(messageLen)),
+	})
+}
+
+func cLogLevel(level types.LogLevel) (C.PW_LOG_LEVEL, error) {
+	switch level {
+	case types.LogTrace:
+		return C.PWL_TRACE, nil
+	case types.LogDebug:
+		return C.PWL_DEBUG, nil
+	case types.LogInfo:
+		return C.PWL_INFO, nil
+	case types.LogWarn:
+		return C.PWL_WARN, nil
+	case types.LogError:
+		return C.PWL_ERROR, nil
+	default:
+		return 0, fmt.Errorf("invalid log level `%d`", level)
+	}
+}
+
+func goLogLevel(level C.PW_LOG_LEVEL) types.LogLevel {
+	switch level {
+	case C.PWL_TRACE:
+		return types.LogTrace
+	case C.PWL_DEBUG:
+		return types.LogDebug
+	case C.PWL_INFO:
+		return types.LogInfo
+	case C.PWL_WARN:
+		return types.LogWarn
+	default:
+		return types.LogError
+	}
+}
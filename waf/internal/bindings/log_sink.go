@@ -0,0 +1,110 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package bindings
+
+import (
+	"sync/atomic"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// Maximum number of log records buffered before being dropped.
+const logBufferSize = 1024
+
+type logRecord struct {
+	level    types.LogLevel
+	function string
+	file     string
+	line     int
+	message  string
+}
+
+// logSink forwards log records to a Go logger from its own goroutine so that
+// the WAF threads logging messages are never blocked by the logger. Records
+// are dropped when the buffer is full.
+type logSink struct {
+	logger  types.Logger
+	records chan logRecord
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+var (
+	// Current log sink, nil when no logger is set.
+	currentLogSink atomic.Value // *logSink
+	// Number of log records dropped since the program started.
+	droppedLogs uint64
+)
+
+func newLogSink(logger types.Logger) *logSink {
+	s := &logSink{
+		logger:  logger,
+		records: make(chan logRecord, logBufferSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *logSink) run() {
+	defer close(s.stopped)
+	for {
+		select {
+		case r := <-s.records:
+			s.log(r)
+		case <-s.done:
+			// Flush what was buffered before being stopped
+			for {
+				select {
+				case r := <-s.records:
+					s.log(r)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *logSink) log(r logRecord) {
+	s.logger.Log(r.level, r.function, r.file, r.line, r.message)
+}
+
+// stop the sink goroutine once the buffered records are logged. The records
+// channel is intentionally never closed so that late senders don't panic.
+func (s *logSink) stop() {
+	close(s.done)
+	<-s.stopped
+}
+
+// push the record to the sink without blocking.
+func (s *logSink) push(r logRecord) {
+	select {
+	case s.records <- r:
+	default:
+		atomic.AddUint64(&droppedLogs, 1)
+	}
+}
+
+// swapLogSink replaces the current log sink and returns the previous one.
+func swapLogSink(s *logSink) (old *logSink) {
+	old, _ = currentLogSink.Load().(*logSink)
+	currentLogSink.Store(s)
+	return old
+}
+
+// logToSink pushes the record to the current sink, if any.
+func logToSink(r logRecord) {
+	if s, _ := currentLogSink.Load().(*logSink); s != nil {
+		s.push(r)
+	}
+}
+
+// DroppedLogs returns the number of WAF log messages that were dropped because
+// the logger was too slow to consume them.
+func DroppedLogs() uint64 {
+	return atomic.LoadUint64(&droppedLogs)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package bindings
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+type testLogger struct {
+	mu       sync.Mutex
+	messages []string
+	block    chan struct{}
+}
+
+func (l *testLogger) Log(_ types.LogLevel, _, _ string, _ int, message string) {
+	if l.block != nil {
+		<-l.block
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, message)
+}
+
+func TestLogSink(t *testing.T) {
+	t.Run("forward", func(t *testing.T) {
+		logger := &testLogger{}
+		sink := newLogSink(logger)
+		require.Nil(t, swapLogSink(sink))
+		logToSink(logRecord{level: types.LogInfo, message: "one"})
+		logToSink(logRecord{level: types.LogInfo, message: "two"})
+		require.Equal(t, sink, swapLogSink(nil))
+		sink.stop()
+		require.Equal(t, []string{"one", "two"}, logger.messages)
+
+		// No longer forwarded
+		logToSink(logRecord{level: types.LogInfo, message: "three"})
+		require.Equal(t, []string{"one", "two"}, logger.messages)
+	})
+
+	t.Run("slow logger", func(t *testing.T) {
+		logger := &testLogger{block: make(chan struct{})}
+		sink := newLogSink(logger)
+		swapLogSink(sink)
+		defer swapLogSink(nil)
+
+		dropped := DroppedLogs()
+		// The sink goroutine may have taken the first record and be blocked
+		// logging it, so that the buffer can still contain logBufferSize records.
+		nbRecords := logBufferSize + 10
+		for i := 0; i < nbRecords; i++ {
+			logToSink(logRecord{level: types.LogInfo, message: "msg"})
+		}
+		nbDropped := DroppedLogs() - dropped
+		require.True(t, nbDropped == 9 || nbDropped == 10, nbDropped)
+
+		close(logger.block)
+		sink.stop()
+		require.Len(t, logger.messages, nbRecords-int(nbDropped))
+	})
+}
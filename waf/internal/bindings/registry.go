@@ -0,0 +1,183 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build !windows
+// +build amd64
+// +build linux darwin
+
+package bindings
+
+// #include <stdlib.h>
+// #include "waf.h"
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/leaks"
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// Registry of named rules relying on the managed API of the WAF, which
+// internally reference-counts the rules so that they can be safely replaced or
+// removed while being used by runs or additive contexts.
+//
+// The native registry is global to the process, so every registry prefixes
+// the names of its rules in order to be independent from the others.
+type Registry struct {
+	prefix string
+	mu     sync.RWMutex
+	// Encoders of the loaded rules, per name
+	rules map[string]Encoder
+}
+
+// Counter of registries used to generate their name prefix.
+var registryCounter uint32
+
+func NewRegistry() *Registry {
+	id := atomic.AddUint32(&registryCounter, 1)
+	return &Registry{
+		prefix: fmt.Sprintf("go-registry-%d/", id),
+		rules:  make(map[string]Encoder),
+	}
+}
+
+// cname returns the native rule name of the given name. It must be freed by
+// the caller.
+func (r *Registry) cname(name string) *C.char {
+	return C.CString(r.prefix + name)
+}
+
+// Load instantiates the rule with the given name and configuration, replacing
+// the previous rule with the same name. The previous rule is released once the
+// runs and additive contexts using it are done. When the rule cannot be
+// loaded, the previous one is kept and the returned error is a
+// *types.InvalidRuleError.
+func (r *Registry) Load(name, rule string, config types.Config) (types.Diagnostics, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config = config.WithDefaults()
+	cconfig := cConfig(config)
+
+	cname := r.cname(name)
+	defer C.free(unsafe.Pointer(cname))
+	crule := C.CString(rule)
+	defer C.free(unsafe.Pointer(crule))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var report *C.char
+	ok := C.pw_init(cname, crule, &cconfig, &report)
+	diags := goDiagnostics(report)
+	C.pw_freeDiagnotics(report)
+	if !ok {
+		return diags, &types.InvalidRuleError{Diagnostics: diags}
+	}
+	r.rules[name] = newEncoder(config)
+	return diags, nil
+}
+
+// Remove the rule with the given name. It is released once the runs and
+// additive contexts using it are done.
+func (r *Registry) Remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.remove(name)
+}
+
+func (r *Registry) remove(name string) {
+	if _, exists := r.rules[name]; !exists {
+		return
+	}
+	cname := r.cname(name)
+	defer C.free(unsafe.Pointer(cname))
+	C.pw_clearRule(cname)
+	delete(r.rules, name)
+}
+
+// Clear removes every rule of the registry. Note that `pw_clearAll()` is not
+// used as it would also clear the rules of the other registries.
+func (r *Registry) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name := range r.rules {
+		r.remove(name)
+	}
+}
+
+// Names returns the sorted list of rule names of the registry.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.rules))
+	for name := range r.rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *Registry) encoder(name string) (Encoder, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.rules[name]
+	return e, ok
+}
+
+// Run the rule with the given name. types.ErrNoRule is returned when there is
+// no such rule.
+func (r *Registry) Run(name string, data types.DataSet, timeout time.Duration) (action types.Action, info []byte, err error) {
+	res, err := r.RunWithResult(name, data, timeout)
+	return res.Action, res.Data, err
+}
+
+func (r *Registry) RunWithResult(name string, data types.DataSet, timeout time.Duration) (types.Result, error) {
+	return r.run(context.Background(), name, data, timeout, false)
+}
+
+func (r *Registry) RunContext(ctx context.Context, name string, data types.DataSet) (action types.Action, info []byte, err error) {
+	res, err := r.run(ctx, name, data, defaultRunTimeout, true)
+	return res.Action, res.Data, err
+}
+
+func (r *Registry) run(ctx context.Context, name string, data types.DataSet, timeout time.Duration, withEncoding bool) (types.Result, error) {
+	encoder, ok := r.encoder(name)
+	if !ok {
+		return types.Result{}, types.ErrNoRule
+	}
+	cname := r.cname(name)
+	defer C.free(unsafe.Pointer(cname))
+	return runEncoded(ctx, encoder, data, timeout, withEncoding, func(v WAFValue, timeout time.Duration) C.PWRet {
+		return C.pw_run(cname, C.PWArgs(v), C.uint64_t(timeout/time.Microsecond))
+	})
+}
+
+// NewAdditiveContext returns a new additive context of the rule with the given
+// name. The context keeps using the rule even if it gets replaced or removed
+// from the registry.
+func (r *Registry) NewAdditiveContext(name string) (types.Rule, error) {
+	encoder, ok := r.encoder(name)
+	if !ok {
+		return nil, types.ErrNoRule
+	}
+	cname := r.cname(name)
+	defer C.free(unsafe.Pointer(cname))
+	handle := C.pw_initAdditive(cname)
+	if handle == nil {
+		return nil, types.ErrNoRule
+	}
+	c := &AdditiveContext{
+		encoder: encoder,
+		handle:  handle,
+	}
+	c.leak = leaks.Track(c, types.ObjectAdditiveContext, types.EngineNative)
+	return c, nil
+}
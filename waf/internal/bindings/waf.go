@@ -10,6 +10,7 @@ package bindings
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"runtime/trace"
@@ -18,7 +19,7 @@ import (
 	"time"
 	"unsafe"
 
-	"github.com/pkg/errors"
+	"github.com/sqreen/go-libsqreen/waf/internal/leaks"
 	"github.com/sqreen/go-libsqreen/waf/types"
 )
 
@@ -33,10 +34,24 @@ import "C"
 
 // Static assert that the function have the expected signatures
 var (
-	_ types.NewRuleFunc            = NewRule
-	_ types.NewAdditiveContextFunc = NewAdditiveContext
-	_ types.VersionFunc            = Version
-	_ types.HealthFunc             = Health
+	_ types.NewRuleFunc                     = NewRule
+	_ types.NewRuleWithDiagnosticsFunc      = NewRuleWithDiagnostics
+	_ types.NewRuleWithConfigFunc           = NewRuleWithConfig
+	_ types.NewAdditiveContextFunc          = NewAdditiveContext
+	_ types.NewAdditiveContextWithErrorFunc = NewAdditiveContextWithError
+	_ types.VersionFunc                     = Version
+	_ types.HealthFunc                      = Health
+	_ types.SetLoggerFunc                   = SetLogger
+)
+
+// Static assert that the types implement the rule interfaces
+var (
+	_ types.Rule          = (*Rule)(nil)
+	_ types.Rule          = (*AdditiveContext)(nil)
+	_ types.ResultRunner  = (*Rule)(nil)
+	_ types.ResultRunner  = (*AdditiveContext)(nil)
+	_ types.ContextRunner = (*Rule)(nil)
+	_ types.ContextRunner = (*AdditiveContext)(nil)
 )
 
 func Version() *string {
@@ -55,29 +70,70 @@ type (
 		handle     C.PWHandle
 		encoder    Encoder
 		refCounter AtomicRefCounter
+		// Set once closed so that the reference of the rule itself is only
+		// released once
+		closed uint32
+		// Leak tracking entry, nil when not tracked
+		leak *leaks.Object
 	}
 )
 
 func NewRule(rule string) (types.Rule, error) {
+	r, _, err := NewRuleWithDiagnostics(rule)
+	return r, err
+}
+
+// NewRuleWithDiagnostics instantiates the WAF rule with the default
+// configuration and returns the diagnostics reported by the WAF.
+func NewRuleWithDiagnostics(rule string) (types.Rule, types.Diagnostics, error) {
+	return NewRuleWithConfig(rule, types.DefaultConfig())
+}
+
+// NewRuleWithConfig instantiates the WAF rule with the given configuration and
+// returns the diagnostics reported by the WAF. When the rule cannot be loaded,
+// the returned error is a *types.InvalidRuleError holding the same
+// diagnostics. Otherwise, the diagnostics are warnings that did not prevent
+// the rule from being loaded.
+func NewRuleWithConfig(rule string, config types.Config) (types.Rule, types.Diagnostics, error) {
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	config = config.WithDefaults()
+
+	cconfig := cConfig(config)
+
 	//sr := stringRef(rule)
 	crule := C.CString(rule)
 	defer C.free(unsafe.Pointer(crule))
-	handle := C.pw_initH(crule, nil, nil)
+	var report *C.char
+	handle := C.pw_initH(crule, &cconfig, &report)
+	diags := goDiagnostics(report)
+	C.pw_freeDiagnotics(report)
 	if handle == nil {
-		return nil, errors.New("could not instantiate the waf rule")
+		return nil, diags, &types.InvalidRuleError{Diagnostics: diags}
 	}
 
 	r := &Rule{
-		handle: handle,
-		encoder: Encoder{
-			MaxValueDepth:   C.PW_MAX_MAP_DEPTH,
-			MaxStringLength: C.PW_MAX_STRING_LENGTH,
-			MaxArrayLength:  C.PW_MAX_ARRAY_LENGTH,
-			MaxMapLength:    C.PW_MAX_ARRAY_LENGTH,
-		},
+		handle:  handle,
+		encoder: newEncoder(config),
 	}
 	r.refCounter.init()
-	return r, nil
+	r.leak = leaks.Track(r, types.ObjectRule, types.EngineNative)
+	return r, diags, nil
+}
+
+// cConfig returns the native configuration of the given configuration, which
+// is expected to be valid and have its default values set.
+func cConfig(config types.Config) C.PWConfig {
+	// The native library applies the same length limit to arrays and maps.
+	maxLength := config.MaxArrayLength
+	if config.MaxMapLength > maxLength {
+		maxLength = config.MaxMapLength
+	}
+	return C.PWConfig{
+		maxArrayLength: C.uint64_t(maxLength),
+		maxMapDepth:    C.uint64_t(config.MaxValueDepth),
+	}
 }
 
 func (r *Rule) addRef() (ok bool) {
@@ -92,9 +148,15 @@ func (r *Rule) unRef() {
 	}
 }
 
-// Close the WAF rule. The underlying C memory is released as soon as there are
-// no more execution contexts using the rule.
+// Close the WAF rule. It can no longer be run nor used to create additive
+// contexts. The underlying C memory is released as soon as there are no more
+// runs and execution contexts using the rule. Closing the rule again has no
+// effect.
 func (r *Rule) Close() error {
+	if !atomic.CompareAndSwapUint32(&r.closed, 0, 1) {
+		return nil
+	}
+	r.leak.Untrack(r)
 	r.unRef()
 	// note that we intentionally let additive contexts continue using the rule,
 	// the reference counting will do the job and deallocate the memory once every
@@ -102,23 +164,113 @@ func (r *Rule) Close() error {
 	return nil
 }
 
+func (r *Rule) isClosed() bool {
+	return atomic.LoadUint32(&r.closed) != 0
+}
+
 func (r *Rule) free() {
 	C.pw_clearRuleH(r.handle)
 	// Set the handle to nil so that unit tests can check this function was called
 	r.handle = nil
 }
 
-func (r Rule) Run(data types.DataSet, timeout time.Duration) (action types.Action, info []byte, err error) {
-	wafValue, err := r.encoder.marshalWAFValue(data)
+func (r *Rule) Run(data types.DataSet, timeout time.Duration) (action types.Action, info []byte, err error) {
+	res, err := r.RunWithResult(data, timeout)
+	return res.Action, res.Data, err
+}
+
+func (r *Rule) RunWithResult(data types.DataSet, timeout time.Duration) (res types.Result, err error) {
+	return r.run(context.Background(), data, timeout, false)
+}
+
+// RunContext runs the rule with the time budget left until the context
+// deadline, or the default WAF budget when it has no deadline, both including
+// the time spent encoding the data. The context error is returned when it is
+// done before the WAF could run, and types.ErrTimeout when the encoding used
+// the whole default budget.
+func (r *Rule) RunContext(ctx context.Context, data types.DataSet) (action types.Action, info []byte, err error) {
+	res, err := r.run(ctx, data, defaultRunTimeout, true)
+	return res.Action, res.Data, err
+}
+
+// run the rule while holding a reference to it, so that closing it
+// concurrently cannot release the rule memory during the WAF call.
+// types.ErrRuleClosed is returned once the rule is closed.
+func (r *Rule) run(ctx context.Context, data types.DataSet, timeout time.Duration, withEncoding bool) (res types.Result, err error) {
+	if r.isClosed() || !r.addRef() {
+		return res, types.ErrRuleClosed
+	}
+	defer r.unRef()
+	return runEncoded(ctx, r.encoder, data, timeout, withEncoding, func(v WAFValue, timeout time.Duration) C.PWRet {
+		return C.pw_runH(r.handle, C.PWArgs(v), C.uint64_t(timeout/time.Microsecond))
+	})
+}
+
+// runEncoded encodes the data set into an arena and calls the WAF run function
+// with the encoded value, which is released once done. The run function must
+// therefore not take the ownership of the value. The timeout includes the
+// encoding time when withEncoding is true.
+func runEncoded(ctx context.Context, encoder Encoder, data types.DataSet, timeout time.Duration, withEncoding bool, run func(WAFValue, time.Duration) C.PWRet) (res types.Result, err error) {
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	arena := newArena()
+	defer arena.release()
+
+	start := time.Now()
+	wafValue, nbValues, stats, err := encoder.encodeArena(data, arena)
+	res.EncodingTime = time.Since(start)
+	res.EncodedValues = nbValues
+	res.EncodeStats = stats
 	if err != nil {
-		return 0, nil, err
+		return res, err
 	}
-	defer wafValue.free()
 
-	ret := C.pw_runH(r.handle, C.PWArgs(wafValue), C.uint64_t(timeout/time.Microsecond))
+	timeout, err = runTimeout(ctx, timeout, encodingTime(res, withEncoding))
+	if err != nil {
+		return res, err
+	}
+
+	ret := run(wafValue, timeout)
 	defer C.pw_freeReturn(ret)
 
-	return goReturnValues(ret)
+	return goResult(ret, res)
+}
+
+// Default time budget of the WAF when running with a context having no
+// deadline.
+const defaultRunTimeout = C.PW_RUN_TIMEOUT * time.Microsecond
+
+// runTimeout returns the time budget of a WAF run. It is the time left until
+// the context deadline, if any, or the given timeout minus the time already
+// spent otherwise. The context error is returned when it is done, and
+// types.ErrTimeout when the timeout was already spent.
+func runTimeout(ctx context.Context, timeout, spent time.Duration) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+		return timeout, nil
+	}
+	timeout -= spent
+	if timeout <= 0 {
+		return 0, types.ErrTimeout
+	}
+	return timeout, nil
+}
+
+// encodingTime returns the encoding time of the result when the timeout
+// includes it, or 0 otherwise.
+func encodingTime(res types.Result, withEncoding bool) time.Duration {
+	if !withEncoding {
+		return 0
+	}
+	return res.EncodingTime
 }
 
 func goRunError(cErr C.PW_RET_CODE, data *C.char) error {
@@ -147,58 +299,142 @@ func goRunError(cErr C.PW_RET_CODE, data *C.char) error {
 }
 
 type AdditiveContext struct {
-	rule   *Rule
-	handle C.PWAddContext
+	// Rule the context was created from, nil when created from a registry
+	rule    *Rule
+	encoder Encoder
+	handle  C.PWAddContext
+	// Serializes the runs and protects the handle from being cleared while in
+	// use
 	mu     sync.Mutex
+	closed bool
+	// Leak tracking entry, nil when not tracked
+	leak *leaks.Object
 }
 
 func NewAdditiveContext(r types.Rule) types.Rule {
+	ctx, _ := NewAdditiveContextWithError(r)
+	if ctx == nil {
+		return nil
+	}
+	return ctx
+}
+
+// NewAdditiveContextWithError returns a new additive context of the rule. The
+// returned error is types.ErrIncompatibleRule when the rule is not a rule of
+// this engine, types.ErrRuleClosed when it was closed, and types.ErrInternal
+// when the WAF could not create the context.
+func NewAdditiveContextWithError(r types.Rule) (types.Rule, error) {
 	rule, _ := r.(*Rule)
 	if rule == nil {
-		return nil
+		return nil, types.ErrIncompatibleRule
 	}
 
-	if !rule.addRef() {
-		return nil
+	if rule.isClosed() || !rule.addRef() {
+		return nil, types.ErrRuleClosed
 	}
 
 	handle := C.pw_initAdditiveH(rule.handle)
 	if handle == nil {
-		return nil
+		rule.unRef()
+		return nil, types.ErrInternal
 	}
 
-	return &AdditiveContext{
-		rule:   rule,
-		handle: handle,
+	c := &AdditiveContext{
+		rule:    rule,
+		encoder: rule.encoder,
+		handle:  handle,
 	}
+	c.leak = leaks.Track(c, types.ObjectAdditiveContext, types.EngineNative)
+	return c, nil
 }
 
 func (c *AdditiveContext) Run(data types.DataSet, timeout time.Duration) (action types.Action, info []byte, err error) {
-	wafValue, err := c.rule.encoder.marshalWAFValue(data)
+	res, err := c.RunWithResult(data, timeout)
+	return res.Action, res.Data, err
+}
+
+func (c *AdditiveContext) RunWithResult(data types.DataSet, timeout time.Duration) (res types.Result, err error) {
+	return c.runWithResult(context.Background(), data, timeout, false)
+}
+
+// RunContext runs the additive context with the time budget left until the
+// context deadline, or the default WAF budget when it has no deadline, both
+// including the time spent encoding the data. The context error is returned
+// when it is done before the WAF could run, and types.ErrTimeout when the
+// encoding used the whole default budget.
+func (c *AdditiveContext) RunContext(ctx context.Context, data types.DataSet) (action types.Action, info []byte, err error) {
+	res, err := c.runWithResult(ctx, data, defaultRunTimeout, true)
+	return res.Action, res.Data, err
+}
+
+func (c *AdditiveContext) runWithResult(ctx context.Context, data types.DataSet, timeout time.Duration, withEncoding bool) (res types.Result, err error) {
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+
+	// The values are allocated individually as the WAF takes their ownership
+	// and frees them itself.
+	start := time.Now()
+	wafValue, nbValues, stats, err := c.encoder.encode(data)
+	res.EncodingTime = time.Since(start)
+	res.EncodedValues = nbValues
+	res.EncodeStats = stats
 	if err != nil {
-		return 0, nil, err
+		return res, err
 	}
 
-	ret := c.run(wafValue, timeout)
+	timeout, err = runTimeout(ctx, timeout, encodingTime(res, withEncoding))
+	if err != nil {
+		// The WAF didn't take the ownership of the value
+		wafValue.free()
+		return res, err
+	}
+
+	ret, err := c.run(wafValue, timeout)
+	if err != nil {
+		return res, err
+	}
 	defer C.pw_freeReturn(ret)
 
-	action, info, err = goReturnValues(ret)
+	res, err = goResult(ret, res)
 	if err == types.ErrInvalidCall || err == types.ErrTimeout {
 		wafValue.free()
 	}
-	return action, info, err
+	return res, err
 }
 
-func (c *AdditiveContext) run(data WAFValue, timeout time.Duration) C.PWRet {
+// run the additive context with the value, whose ownership is taken by the WAF
+// unless the context is closed, in which case it is freed and
+// types.ErrContextClosed is returned.
+func (c *AdditiveContext) run(data WAFValue, timeout time.Duration) (C.PWRet, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return C.pw_runAdditive(c.handle, C.PWArgs(data), C.uint64_t(timeout/time.Microsecond))
+	if c.closed {
+		data.free()
+		return C.PWRet{}, types.ErrContextClosed
+	}
+	return C.pw_runAdditive(c.handle, C.PWArgs(data), C.uint64_t(timeout/time.Microsecond)), nil
 }
 
+// Close the additive context and release its rule reference. It waits for the
+// run in progress, if any. Closing the context again has no effect, and runs
+// then return types.ErrContextClosed.
 func (c *AdditiveContext) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.leak.Untrack(c)
 	trace.Log(context.Background(), "sqreen/waf", "rule additive context memory release")
 	C.pw_clearAdditive(c.handle)
-	return c.rule.Close()
+	c.handle = nil
+	if c.rule != nil {
+		// Release the reference of the context
+		c.rule.unRef()
+	}
+	return nil
 }
 
 func goReturnValues(ret C.PWRet) (action types.Action, info []byte, err error) {
@@ -216,6 +452,21 @@ func goReturnValues(ret C.PWRet) (action types.Action, info []byte, err error) {
 	return action, info, err
 }
 
+// goResult completes the given result with the values returned by the WAF.
+func goResult(ret C.PWRet, res types.Result) (types.Result, error) {
+	res.TotalRuntime = time.Duration(ret.perfTotalRuntime) * time.Microsecond
+	res.CacheHitRate = uint32(ret.perfCacheHitRate)
+	if ret.perfData != nil {
+		perfData := C.GoBytes(unsafe.Pointer(ret.perfData), C.int(C.strlen(ret.perfData)))
+		// The performance report is informative, so ignore it when invalid.
+		_ = json.Unmarshal(perfData, &res.PerfData)
+	}
+
+	var err error
+	res.Action, res.Data, err = goReturnValues(ret)
+	return res, err
+}
+
 type AtomicRefCounter uint32
 
 func (i *AtomicRefCounter) unwrap() *uint32 {
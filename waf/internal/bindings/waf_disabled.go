@@ -7,6 +7,10 @@
 package bindings
 
 import (
+	"context"
+	"io"
+	"time"
+
 	"github.com/sqreen/go-libsqreen/waf/types"
 )
 
@@ -14,17 +18,111 @@ func NewRule(string) (types.Rule, error) {
 	return nil, disabledError
 }
 
+func NewRuleWithDiagnostics(string) (types.Rule, types.Diagnostics, error) {
+	return nil, nil, disabledError
+}
+
+func NewRuleWithConfig(string, types.Config) (types.Rule, types.Diagnostics, error) {
+	return nil, nil, disabledError
+}
+
 func NewAdditiveContext(types.Rule) types.Rule {
 	return nil
 }
 
+func NewAdditiveContextWithError(types.Rule) (types.Rule, error) {
+	return nil, disabledError
+}
+
 func Version() *string { return nil }
 
+func SetLogger(types.Logger, types.LogLevel) error { return disabledError }
+
 func Health() error { return disabledError }
 
+func DumpDataSet(io.Writer, types.DataSet, types.Config) error { return disabledError }
+
+// Rule and AdditiveContext provide the same methods as in the cgo build, but
+// they cannot be instantiated.
+type (
+	Rule            struct{}
+	AdditiveContext struct{}
+)
+
+func (*Rule) Run(types.DataSet, time.Duration) (types.Action, []byte, error) {
+	return types.NoAction, nil, disabledError
+}
+
+func (*Rule) RunWithResult(types.DataSet, time.Duration) (types.Result, error) {
+	return types.Result{}, disabledError
+}
+
+func (*Rule) RunContext(context.Context, types.DataSet) (types.Action, []byte, error) {
+	return types.NoAction, nil, disabledError
+}
+
+func (*Rule) Close() error { return disabledError }
+
+func (*AdditiveContext) Run(types.DataSet, time.Duration) (types.Action, []byte, error) {
+	return types.NoAction, nil, disabledError
+}
+
+func (*AdditiveContext) RunWithResult(types.DataSet, time.Duration) (types.Result, error) {
+	return types.Result{}, disabledError
+}
+
+func (*AdditiveContext) RunContext(context.Context, types.DataSet) (types.Action, []byte, error) {
+	return types.NoAction, nil, disabledError
+}
+
+func (*AdditiveContext) Close() error { return disabledError }
+
+type Registry struct{}
+
+func NewRegistry() *Registry { return &Registry{} }
+
+func (*Registry) Load(string, string, types.Config) (types.Diagnostics, error) {
+	return nil, disabledError
+}
+
+func (*Registry) Remove(string) {}
+
+func (*Registry) Clear() {}
+
+func (*Registry) Names() []string { return nil }
+
+func (*Registry) Run(string, types.DataSet, time.Duration) (types.Action, []byte, error) {
+	return types.NoAction, nil, disabledError
+}
+
+func (*Registry) RunWithResult(string, types.DataSet, time.Duration) (types.Result, error) {
+	return types.Result{}, disabledError
+}
+
+func (*Registry) RunContext(context.Context, string, types.DataSet) (types.Action, []byte, error) {
+	return types.NoAction, nil, disabledError
+}
+
+func (*Registry) NewAdditiveContext(string) (types.Rule, error) {
+	return nil, disabledError
+}
+
 // Static assert that the function have the expected signatures
 var (
-	_ types.NewRuleFunc = NewRule
-	_ types.VersionFunc = Version
-	_ types.HealthFunc  = Health
+	_ types.NewRuleFunc                = NewRule
+	_ types.NewRuleWithDiagnosticsFunc = NewRuleWithDiagnostics
+	_ types.NewRuleWithConfigFunc      = NewRuleWithConfig
+	_ types.VersionFunc                = Version
+	_ types.HealthFunc                 = Health
+	_ types.SetLoggerFunc              = SetLogger
+)
+
+// Static assert that the types implement the rule interfaces
+var (
+	_ types.Rule          = (*Rule)(nil)
+	_ types.Rule          = (*AdditiveContext)(nil)
+	_ types.ResultRunner  = (*Rule)(nil)
+	_ types.ResultRunner  = (*AdditiveContext)(nil)
+	_ types.ContextRunner = (*Rule)(nil)
+	_ types.ContextRunner = (*AdditiveContext)(nil)
 )
@@ -0,0 +1,40 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build !cgo amd64,windows !amd64
+
+package bindings
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisabledRule(t *testing.T) {
+	type rule interface {
+		types.Rule
+		types.ResultRunner
+		types.ContextRunner
+	}
+	for _, r := range []rule{&Rule{}, &AdditiveContext{}} {
+		_, _, err := r.Run(types.DataSet{}, time.Second)
+		require.Equal(t, disabledError, err)
+		_, err = r.RunWithResult(types.DataSet{}, time.Second)
+		require.Equal(t, disabledError, err)
+		_, _, err = r.RunContext(context.Background(), types.DataSet{})
+		require.Equal(t, disabledError, err)
+		require.Equal(t, disabledError, r.Close())
+	}
+}
+
+func TestDisabledAdditiveContext(t *testing.T) {
+	require.Nil(t, NewAdditiveContext(&Rule{}))
+	ctx, err := NewAdditiveContextWithError(&Rule{})
+	require.Equal(t, disabledError, err)
+	require.Nil(t, ctx)
+}
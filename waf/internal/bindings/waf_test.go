@@ -10,9 +10,17 @@
 package bindings
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/big"
 	"math/rand"
-	"reflect"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,6 +32,221 @@ func TestNewRule(t *testing.T) {
 	r, err := NewRule(`{ oops`)
 	require.Error(t, err)
 	require.Nil(t, r)
+
+	r, diags, err := NewRuleWithDiagnostics(`{ oops`)
+	require.Error(t, err)
+	require.Nil(t, r)
+	require.IsType(t, &types.InvalidRuleError{}, err)
+	require.Equal(t, diags, err.(*types.InvalidRuleError).Diagnostics)
+}
+
+func TestNewRuleWithConfig(t *testing.T) {
+	rule := `{"rules": [], "flows": []}`
+
+	t.Run("default values", func(t *testing.T) {
+		r, _, err := NewRuleWithConfig(rule, types.Config{MaxMapLength: 1024})
+		require.NoError(t, err)
+		defer r.Close()
+		require.Equal(t, Encoder{
+			MaxValueDepth:   types.DefaultMaxValueDepth,
+			MaxStringLength: types.DefaultMaxStringLength,
+			MaxArrayLength:  types.DefaultMaxArrayLength,
+			MaxMapLength:    1024,
+			Marshalers:      types.DefaultMarshalers(),
+		}, r.(*Rule).encoder)
+	})
+
+	t.Run("out of range values", func(t *testing.T) {
+		for _, config := range []types.Config{
+			{MaxValueDepth: -1},
+			{MaxStringLength: types.MaxStringLengthLimit + 1},
+			{MaxArrayLength: -1},
+			{MaxMapLength: types.MaxMapLengthLimit + 1},
+		} {
+			r, _, err := NewRuleWithConfig(rule, config)
+			require.Error(t, err)
+			require.Nil(t, r)
+		}
+	})
+}
+
+func TestRunTimeout(t *testing.T) {
+	// The time already spent is deducted from the timeout
+	timeout, err := runTimeout(context.Background(), time.Second, time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, time.Second-time.Millisecond, timeout)
+
+	timeout, err = runTimeout(context.Background(), time.Millisecond, time.Second)
+	require.Equal(t, types.ErrTimeout, err)
+	require.Zero(t, timeout)
+
+	// The context deadline takes precedence
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	timeout, err = runTimeout(ctx, time.Millisecond, time.Second)
+	require.NoError(t, err)
+	require.True(t, timeout > time.Minute)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = runTimeout(ctx, time.Second, 0)
+	require.Equal(t, context.Canceled, err)
+}
+
+// Rule blocking the requests having the user-agent `Arachni`
+const testArachniRule = `{
+  "manifest": { "user-agent": { "inherit_from": "user-agent", "run_on_value": true, "run_on_key": false } },
+  "rules": [ { "rule_id": "1", "filters": [ { "operator": "@rx", "targets": ["user-agent"], "value": "Arachni" } ] } ],
+  "flows": [ { "name": "arachni_detection", "steps": [ { "id": "start", "rule_ids": ["1"], "on_match": "exit_block" } ] } ]
+}`
+
+func TestRuleClose(t *testing.T) {
+	data := types.DataSet{"user-agent": "Arachni"}
+
+	t.Run("closed rule", func(t *testing.T) {
+		r, err := NewRule(testArachniRule)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		require.Nil(t, r.(*Rule).handle)
+
+		// Closing again has no effect
+		require.NoError(t, r.Close())
+
+		_, _, err = r.Run(data, time.Second)
+		require.Equal(t, types.ErrRuleClosed, err)
+		_, err = r.(*Rule).RunWithResult(data, time.Second)
+		require.Equal(t, types.ErrRuleClosed, err)
+		_, _, err = r.(*Rule).RunContext(context.Background(), data)
+		require.Equal(t, types.ErrRuleClosed, err)
+		require.Nil(t, NewAdditiveContext(r))
+	})
+
+	t.Run("additive context", func(t *testing.T) {
+		r, err := NewRule(testArachniRule)
+		require.NoError(t, err)
+		ctx := NewAdditiveContext(r)
+		require.NotNil(t, ctx)
+
+		// The context keeps the rule alive
+		require.NoError(t, r.Close())
+		require.NoError(t, r.Close())
+		require.NotNil(t, r.(*Rule).handle)
+		action, _, err := ctx.Run(data, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+
+		require.NoError(t, ctx.Close())
+		require.Nil(t, r.(*Rule).handle)
+	})
+
+	t.Run("concurrent runs", func(t *testing.T) {
+		// Rules are closed while being run, which must not release their memory
+		// before the runs in progress are done.
+		for i := 0; i < 100; i++ {
+			r, err := NewRule(testArachniRule)
+			require.NoError(t, err)
+
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						action, _, err := r.Run(data, time.Second)
+						if err == types.ErrRuleClosed {
+							return
+						}
+						if err != nil || action != types.BlockAction {
+							t.Errorf("action=`%v` err=`%v`", action, err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Add(2)
+			for g := 0; g < 2; g++ {
+				go func() {
+					defer wg.Done()
+					time.Sleep(time.Millisecond)
+					r.Close()
+				}()
+			}
+			wg.Wait()
+			require.Nil(t, r.(*Rule).handle)
+		}
+	})
+}
+
+func TestNewAdditiveContext(t *testing.T) {
+	data := types.DataSet{"user-agent": "Arachni"}
+
+	t.Run("incompatible rule", func(t *testing.T) {
+		for _, r := range []types.Rule{nil, (*Rule)(nil), &AdditiveContext{}} {
+			ctx, err := NewAdditiveContextWithError(r)
+			require.Equal(t, types.ErrIncompatibleRule, err)
+			require.Nil(t, ctx)
+			require.Nil(t, NewAdditiveContext(r))
+		}
+	})
+
+	t.Run("closed rule", func(t *testing.T) {
+		r, err := NewRule(testArachniRule)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		ctx, err := NewAdditiveContextWithError(r)
+		require.Equal(t, types.ErrRuleClosed, err)
+		require.Nil(t, ctx)
+	})
+
+	t.Run("closed context", func(t *testing.T) {
+		r, err := NewRule(testArachniRule)
+		require.NoError(t, err)
+		defer r.Close()
+		ctx, err := NewAdditiveContextWithError(r)
+		require.NoError(t, err)
+		action, _, err := ctx.Run(data, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+
+		// The rule reference of the context is only released once
+		require.NoError(t, ctx.Close())
+		require.NoError(t, ctx.Close())
+		require.Nil(t, ctx.(*AdditiveContext).handle)
+		require.Equal(t, uint32(1), atomic.LoadUint32(r.(*Rule).refCounter.unwrap()))
+
+		_, _, err = ctx.Run(data, time.Second)
+		require.Equal(t, types.ErrContextClosed, err)
+		_, err = ctx.(*AdditiveContext).RunWithResult(data, time.Second)
+		require.Equal(t, types.ErrContextClosed, err)
+		_, _, err = ctx.(*AdditiveContext).RunContext(context.Background(), data)
+		require.Equal(t, types.ErrContextClosed, err)
+	})
+
+	t.Run("concurrent close", func(t *testing.T) {
+		r, err := NewRule(testArachniRule)
+		require.NoError(t, err)
+		defer r.Close()
+		for i := 0; i < 100; i++ {
+			ctx, err := NewAdditiveContextWithError(r)
+			require.NoError(t, err)
+			var wg sync.WaitGroup
+			for g := 0; g < 4; g++ {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					if _, _, err := ctx.Run(data, time.Second); err != nil && err != types.ErrContextClosed {
+						t.Error(err)
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					ctx.Close()
+				}()
+			}
+			wg.Wait()
+		}
+		require.Equal(t, uint32(1), atomic.LoadUint32(r.(*Rule).refCounter.unwrap()))
+	})
 }
 
 func TestMarshal(t *testing.T) {
@@ -33,10 +256,16 @@ func TestMarshal(t *testing.T) {
 		ExpectedError          error
 		ExpectedWAFValueType   int
 		ExpectedWAFValueLength int
+		ExpectedValue          interface{}
 		MaxValueDepth          int
 		MaxArrayLength         int
 		MaxMapLength           int
 		MaxStringLength        int
+		Marshalers             []types.Marshaler
+		StrictMapKeys          bool
+		JSONTagFallback        bool
+		FloatEncoding          types.FloatEncoding
+		BytesEncoding          types.BytesEncoding
 	}{
 		{
 			Name:          "unsupported type",
@@ -46,9 +275,45 @@ func TestMarshal(t *testing.T) {
 		{
 			Name:                   "zero time value",
 			Data:                   time.Time{},
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("0001-01-01T00:00:00Z"),
+		},
+		{
+			Name:                   "zero time value without marshalers",
+			Data:                   time.Time{},
+			Marshalers:             []types.Marshaler{},
 			ExpectedWAFValueType:   wafMapType,
 			ExpectedWAFValueLength: 0,
 		},
+		{
+			Name:                   "text marshaler",
+			Data:                   net.IPv4(127, 0, 0, 1),
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("127.0.0.1"),
+		},
+		{
+			Name:                   "stringer with a pointer receiver",
+			Data:                   url.URL{Scheme: "https", Host: "sqreen.io", Path: "/"},
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("https://sqreen.io/"),
+		},
+		{
+			Name:                   "addressable stringer with a pointer receiver",
+			Data:                   []url.URL{{Scheme: "https", Host: "sqreen.io", Path: "/"}},
+			ExpectedWAFValueType:   wafArrayType,
+			ExpectedWAFValueLength: 1,
+		},
+		{
+			Name:          "nil stringer",
+			Data:          (*url.URL)(nil),
+			ExpectedError: ErrUnsupportedValue,
+		},
+		{
+			Name:                   "nil stringer in a map",
+			Data:                   map[string]fmt.Stringer{"k1": (*url.URL)(nil), "k2": time.Second},
+			ExpectedWAFValueType:   wafMapType,
+			ExpectedWAFValueLength: 1,
+		},
 		{
 			Name:          "nil interface value",
 			Data:          nil,
@@ -100,6 +365,104 @@ func TestMarshal(t *testing.T) {
 			Data:                 33.12345,
 			ExpectedWAFValueType: wafStringType, // waf internals: number are converted into strings
 		},
+		{
+			Name:                   "float as string",
+			Data:                   33.12345,
+			FloatEncoding:          types.FloatString,
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("33.12345"),
+		},
+		{
+			Name:                   "float32 as string",
+			Data:                   float32(0.1),
+			FloatEncoding:          types.FloatString,
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("0.1"),
+		},
+		{
+			Name:                   "float out of the int64 range",
+			Data:                   1.0e308,
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("1e+308"),
+		},
+		{
+			Name:                   "nan",
+			Data:                   math.NaN(),
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("NaN"),
+		},
+		{
+			Name:                   "negative infinity",
+			Data:                   math.Inf(-1),
+			FloatEncoding:          types.FloatString,
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("-Inf"),
+		},
+		{
+			Name:                   "json number",
+			Data:                   json.Number("1.0e308"),
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("1.0e308"),
+		},
+		{
+			Name:                   "big int",
+			Data:                   testBigInt,
+			Marshalers:             []types.Marshaler{},
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len(testBigInt.String()),
+		},
+		{
+			Name:                   "big float",
+			Data:                   *big.NewFloat(1.5),
+			Marshalers:             []types.Marshaler{},
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("1.5"),
+		},
+		{
+			Name:          "nil big int",
+			Data:          (*big.Int)(nil),
+			ExpectedError: ErrUnsupportedValue,
+		},
+		{
+			Name:                   "byte slice",
+			Data:                   []byte("body"),
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("body"),
+		},
+		{
+			Name:                   "byte slice max length",
+			Data:                   []byte("body"),
+			MaxStringLength:        2,
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: 2,
+		},
+		{
+			Name:                   "json raw message",
+			Data:                   json.RawMessage(`"quoted"`),
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len(`"quoted"`),
+		},
+		{
+			Name:                   "reader",
+			Data:                   strings.NewReader("body"),
+			MaxStringLength:        2,
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: 2,
+		},
+		{
+			Name:                   "invalid utf-8 bytes",
+			Data:                   []byte("a\xffb"),
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len("a\xffb"),
+		},
+		{
+			Name:                   "escaped invalid utf-8 bytes",
+			Data:                   []byte("a\xffb"),
+			BytesEncoding:          types.BytesEscaped,
+			ExpectedWAFValueType:   wafStringType,
+			ExpectedWAFValueLength: len(`a\xffb`),
+			ExpectedValue:          `a\xffb`,
+		},
 		{
 			Name:                   "slice",
 			Data:                   []interface{}{33.12345, "ok", 27},
@@ -111,6 +474,7 @@ func TestMarshal(t *testing.T) {
 			Data:                   []interface{}{33.12345, func() {}, "ok", 27, nil},
 			ExpectedWAFValueType:   wafArrayType,
 			ExpectedWAFValueLength: 3,
+			ExpectedValue:          []interface{}{"33", "ok", "27"},
 		},
 		{
 			Name:                   "array",
@@ -126,15 +490,61 @@ func TestMarshal(t *testing.T) {
 		},
 		{
 			Name:                   "map with invalid key type",
-			Data:                   map[interface{}]interface{}{"k1": 1, 27: "int key", "k2": "2"},
+			Data:                   map[interface{}]interface{}{"k1": 1, 27: "int key", 1.5: "float key", "k2": "2"},
+			ExpectedWAFValueType:   wafMapType,
+			ExpectedWAFValueLength: 3,
+			ExpectedValue:          map[string]interface{}{"k1": "1", "27": "int key", "k2": "2"},
+		},
+		{
+			Name:                   "map with invalid key type and strict map keys",
+			Data:                   map[interface{}]interface{}{"k1": 1, 27: "int key", 1.5: "float key", "k2": "2"},
+			StrictMapKeys:          true,
+			ExpectedWAFValueType:   wafMapType,
+			ExpectedWAFValueLength: 2,
+			ExpectedValue:          map[string]interface{}{"k1": "1", "k2": "2"},
+		},
+		{
+			Name:                   "map with integer keys",
+			Data:                   map[int8]string{-1: "a", 2: "b"},
+			ExpectedWAFValueType:   wafMapType,
+			ExpectedWAFValueLength: 2,
+			ExpectedValue:          map[string]interface{}{"-1": "a", "2": "b"},
+		},
+		{
+			Name:                   "map with unsigned integer keys",
+			Data:                   map[uint64]string{math.MaxUint64: "a"},
+			ExpectedWAFValueType:   wafMapType,
+			ExpectedWAFValueLength: 1,
+			ExpectedValue:          map[string]interface{}{"18446744073709551615": "a"},
+		},
+		{
+			Name:                   "map with boolean keys",
+			Data:                   map[bool]int{true: 1, false: 0},
 			ExpectedWAFValueType:   wafMapType,
 			ExpectedWAFValueLength: 2,
+			ExpectedValue:          map[string]interface{}{"true": "1", "false": "0"},
+		},
+		{
+			Name:                   "map with marshaler keys",
+			Data:                   map[time.Duration]string{time.Second: "1s"},
+			ExpectedWAFValueType:   wafMapType,
+			ExpectedWAFValueLength: 1,
+			ExpectedValue:          map[string]interface{}{"1s": "1s"},
+		},
+		{
+			Name:                   "map with marshaler keys and no marshalers",
+			Data:                   map[time.Duration]string{time.Second: "1s"},
+			Marshalers:             []types.Marshaler{},
+			ExpectedWAFValueType:   wafMapType,
+			ExpectedWAFValueLength: 1,
+			ExpectedValue:          map[string]interface{}{"1000000000": "1s"},
 		},
 		{
 			Name:                   "map with indirect string values",
 			Data:                   map[interface{}]interface{}{"k1": 1, new(string): "string pointer key", "k2": "2"},
 			ExpectedWAFValueType:   wafMapType,
 			ExpectedWAFValueLength: 3,
+			ExpectedValue:          map[string]interface{}{"k1": "1", "": "string pointer key", "k2": "2"},
 		},
 		{
 			Name: "struct",
@@ -168,6 +578,47 @@ func TestMarshal(t *testing.T) {
 			ExpectedWAFValueType:   wafMapType,
 			ExpectedWAFValueLength: 1, // public fields of supported types
 		},
+		{
+			Name: "struct with tags",
+			Data: struct {
+				Renamed   string `waf:"renamed"`
+				Password  string `waf:"-"`
+				Omitted   string `waf:",omitempty"`
+				Kept      string `waf:"kept,omitempty"`
+				JSONField string `json:"-"`
+			}{
+				Renamed:   "renamed",
+				Password:  "secret",
+				Kept:      "kept",
+				JSONField: "json",
+			},
+			ExpectedWAFValueType:   wafMapType,
+			ExpectedWAFValueLength: 3, // the json tag is not used by default
+			ExpectedValue:          map[string]interface{}{"renamed": "renamed", "kept": "kept", "JSONField": "json"},
+		},
+		{
+			Name: "struct with json tags",
+			Data: struct {
+				Renamed   string `waf:"renamed"`
+				JSONField string `json:"-"`
+				Both      string `waf:"both" json:"-"`
+			}{},
+			JSONTagFallback:        true,
+			ExpectedWAFValueType:   wafMapType,
+			ExpectedWAFValueLength: 2,
+		},
+		{
+			Name: "struct with embedded structs",
+			Data: struct {
+				testEmbedded
+				*testEmbeddedPointer
+				Field string
+			}{
+				testEmbedded: testEmbedded{Field: "hidden", Embedded: "embedded"},
+			},
+			ExpectedWAFValueType:   wafMapType,
+			ExpectedWAFValueLength: 2, // the nil embedded pointer fields are omitted
+		},
 		{
 			Name:                   "array max depth",
 			MaxValueDepth:          1,
@@ -181,6 +632,7 @@ func TestMarshal(t *testing.T) {
 			Data:                   map[string]interface{}{"k1": "v1", "k2": "v2", "k3": "v3", "k4": "v4", "k5": map[string]string{}},
 			ExpectedWAFValueType:   wafMapType,
 			ExpectedWAFValueLength: 4,
+			ExpectedValue:          map[string]interface{}{"k1": "v1", "k2": "v2", "k3": "v3", "k4": "v4"},
 		},
 		{
 			Name:                   "array max length",
@@ -195,6 +647,7 @@ func TestMarshal(t *testing.T) {
 			Data:                   map[string]string{"k1": "v1", "k2": "v2", "k3": "v3", "k4": "v4", "k5": "v5"},
 			ExpectedWAFValueType:   wafMapType,
 			ExpectedWAFValueLength: 3,
+			ExpectedValue:          map[string]interface{}{"k1": "v1", "k2": "v2", "k3": "v3"},
 		},
 		{
 			Name:                   "string max length",
@@ -209,6 +662,7 @@ func TestMarshal(t *testing.T) {
 			Data:                   map[string]string{"k1": "v1", "k2": "v2", "k3": "v3", "k4": "v4", "k5": "v5"},
 			ExpectedWAFValueType:   wafMapType,
 			ExpectedWAFValueLength: 5,
+			ExpectedValue:          map[string]interface{}{"k": "v"},
 		},
 	} {
 		tc := tc
@@ -229,13 +683,22 @@ func TestMarshal(t *testing.T) {
 			if max := tc.MaxStringLength; max != 0 {
 				maxStringLength = max
 			}
+			marshalers := types.DefaultMarshalers()
+			if tc.Marshalers != nil {
+				marshalers = tc.Marshalers
+			}
 			m := Encoder{
 				MaxValueDepth:   maxValueDepth,
 				MaxStringLength: maxStringLength,
 				MaxArrayLength:  maxArrayLength,
 				MaxMapLength:    maxMapLength,
+				Marshalers:      marshalers,
+				StrictMapKeys:   tc.StrictMapKeys,
+				JSONTagFallback: tc.JSONTagFallback,
+				FloatEncoding:   tc.FloatEncoding,
+				BytesEncoding:   tc.BytesEncoding,
 			}
-			v, err := m.marshalWAFValueRec(reflect.ValueOf(tc.Data), 0)
+			v, _, _, err := m.marshal(tc.Data, nil)
 			if tc.ExpectedError != nil {
 				require.Error(t, err)
 				require.Equal(t, tc.ExpectedError, err)
@@ -253,10 +716,77 @@ func TestMarshal(t *testing.T) {
 			if tc.ExpectedWAFValueLength != 0 {
 				require.Equal(t, tc.ExpectedWAFValueLength, int(v.nbEntries), "waf value type")
 			}
+			if tc.ExpectedValue != nil {
+				require.Equal(t, tc.ExpectedValue, decodeValue(t, v))
+			}
 		})
 	}
 }
 
+var testBigInt, _ = new(big.Int).SetString("123456789012345678901234567890", 10)
+
+type (
+	testEmbedded struct {
+		Field    string
+		Embedded string
+	}
+
+	testEmbeddedPointer struct {
+		Pointer string
+	}
+)
+
+func TestEncode(t *testing.T) {
+	e := newEncoder(types.DefaultConfig())
+	v, nbValues, stats, err := e.encode(types.DataSet{
+		"k1": []string{"v1", "v2"},
+		"k2": 33,
+		"k3": func() {},
+	})
+	require.NoError(t, err)
+	defer v.free()
+	// The map, the array, its two strings and the number
+	require.Equal(t, 5, nbValues)
+	require.Equal(t, types.EncodeStats{
+		UnsupportedValues: 1,
+		Events: []types.EncodeEvent{
+			{Issue: types.EncodeUnsupportedValue, KeyPath: []string{"k3"}},
+		},
+	}, stats)
+	// The encoder accounting is per call
+	v, nbValues, stats, err = e.encode(types.DataSet{"k": "v"})
+	require.NoError(t, err)
+	defer v.free()
+	require.Equal(t, 2, nbValues)
+	require.True(t, stats.Complete())
+}
+
+func TestEncodeStats(t *testing.T) {
+	e := newEncoder(types.Config{
+		MaxValueDepth:   2,
+		MaxStringLength: 3,
+		MaxArrayLength:  2,
+		MaxMapLength:    2,
+	}.WithDefaults())
+	v, _, stats, err := e.encode(types.DataSet{
+		"long": []interface{}{"abcd", []int{1}, 3, 4},
+	})
+	require.NoError(t, err)
+	defer v.free()
+	require.Equal(t, types.EncodeStats{
+		TruncatedStrings:    2,
+		DroppedArrayEntries: 1,
+		DepthCutoffs:        1,
+		Events: []types.EncodeEvent{
+			{Issue: types.EncodeTruncatedString, KeyPath: []string{"long", "0"}},
+			{Issue: types.EncodeDepthCutoff, KeyPath: []string{"long", "1"}},
+			{Issue: types.EncodeDroppedArrayEntries, KeyPath: []string{"long"}},
+			{Issue: types.EncodeTruncatedString, KeyPath: []string{"long"}},
+		},
+	}, stats)
+	require.False(t, stats.Complete())
+}
+
 func TestFreeWAFValue(t *testing.T) {
 	// Test we don't crash the process
 
@@ -305,7 +835,7 @@ func BenchmarkMarshal(b *testing.B) {
 			}
 			b.ResetTimer()
 			for n := 0; n < b.N; n++ {
-				v, err := marshaler.marshalWAFValue(data)
+				v, _, _, err := marshaler.marshal(data, nil)
 				if err != nil {
 					b.Fatal(err)
 				}
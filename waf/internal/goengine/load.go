@@ -0,0 +1,303 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package goengine
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// JSON rule format, made of a manifest of targets, rules and flows.
+type (
+	ruleFileDef struct {
+		Manifest map[string]manifestEntryDef `json:"manifest"`
+		Rules    []json.RawMessage           `json:"rules"`
+		Flows    []json.RawMessage           `json:"flows"`
+	}
+
+	manifestEntryDef struct {
+		InheritFrom string `json:"inherit_from"`
+		RunOnValue  *bool  `json:"run_on_value"`
+		RunOnKey    bool   `json:"run_on_key"`
+	}
+
+	ruleDef struct {
+		ID      string            `json:"rule_id"`
+		Filters []json.RawMessage `json:"filters"`
+	}
+
+	filterDef struct {
+		Operator string          `json:"operator"`
+		Targets  []string        `json:"targets"`
+		Value    json.RawMessage `json:"value"`
+		Options  operatorOptions `json:"options"`
+	}
+
+	flowDef struct {
+		Name  string            `json:"name"`
+		Steps []json.RawMessage `json:"steps"`
+	}
+
+	stepDef struct {
+		ID        string   `json:"id"`
+		RuleIDs   []string `json:"rule_ids"`
+		OnMatch   string   `json:"on_match"`
+		OnNoMatch string   `json:"on_no_match"`
+	}
+)
+
+// Compiled rule file.
+type (
+	// target is a value of the data set the filter operator runs on.
+	target struct {
+		// Manifest key of the target
+		key string
+		// Address of the value in the data set
+		address    string
+		runOnValue bool
+		runOnKey   bool
+	}
+
+	rule struct {
+		id      string
+		filters []filter
+	}
+
+	filter struct {
+		operator operator
+		targets  []target
+	}
+
+	flow struct {
+		name  string
+		steps []step
+	}
+
+	step struct {
+		id        string
+		rules     []*rule
+		onMatch   transition
+		onNoMatch transition
+	}
+
+	// transition is what happens after a flow step: either exiting the flow
+	// with an action, or continuing to another step.
+	transition struct {
+		exit   bool
+		action types.Action
+		next   int
+	}
+)
+
+const (
+	exitMonitor = "exit_monitor"
+	exitBlock   = "exit_block"
+)
+
+// loader compiles the JSON rule file while collecting the diagnostics. Invalid
+// rules, filters and flows are ignored and reported in the diagnostics.
+type loader struct {
+	manifest map[string]manifestEntryDef
+	rules    map[string]*rule
+	diags    types.Diagnostics
+}
+
+func (l *loader) diag(d types.Diagnostic) {
+	l.diags = append(l.diags, d)
+}
+
+// load the JSON rule file. The returned error is a *types.InvalidRuleError
+// when the file is not valid JSON object.
+func load(ruleFile string) ([]flow, types.Diagnostics, error) {
+	var def ruleFileDef
+	if err := json.Unmarshal([]byte(ruleFile), &def); err != nil {
+		diags := types.Diagnostics{{Code: types.DiagParsingJSON, Message: err.Error()}}
+		return nil, diags, &types.InvalidRuleError{Diagnostics: diags}
+	}
+
+	l := loader{
+		manifest: def.Manifest,
+		rules:    make(map[string]*rule, len(def.Rules)),
+	}
+	for _, r := range def.Rules {
+		l.loadRule(r)
+	}
+	flows := make([]flow, 0, len(def.Flows))
+	flowNames := make(map[string]struct{}, len(def.Flows))
+	for _, raw := range def.Flows {
+		f, ok := l.loadFlow(raw)
+		if !ok {
+			continue
+		}
+		if _, exists := flowNames[f.name]; exists {
+			l.diag(types.Diagnostic{Code: types.DiagDuplicateFlow, FlowName: f.name})
+			continue
+		}
+		flowNames[f.name] = struct{}{}
+		flows = append(flows, f)
+	}
+	return flows, l.diags, nil
+}
+
+func (l *loader) loadRule(raw json.RawMessage) {
+	var def ruleDef
+	if err := json.Unmarshal(raw, &def); err != nil || def.ID == "" {
+		msg := "missing rule id"
+		if err != nil {
+			msg = err.Error()
+		}
+		l.diag(types.Diagnostic{Code: types.DiagParsingRule, RuleID: def.ID, Message: msg})
+		return
+	}
+	if _, exists := l.rules[def.ID]; exists {
+		l.diag(types.Diagnostic{Code: types.DiagDuplicateRule, RuleID: def.ID})
+		return
+	}
+	if len(def.Filters) == 0 {
+		l.diag(types.Diagnostic{Code: types.DiagParsingRule, RuleID: def.ID, Message: "missing rule filters"})
+		return
+	}
+
+	r := &rule{id: def.ID, filters: make([]filter, 0, len(def.Filters))}
+	for _, raw := range def.Filters {
+		f, ok := l.loadFilter(def.ID, raw)
+		if !ok {
+			// A rule matches when every filter matches, so it is invalid as soon
+			// as one of its filters is.
+			return
+		}
+		r.filters = append(r.filters, f)
+	}
+	l.rules[def.ID] = r
+}
+
+func (l *loader) loadFilter(ruleID string, raw json.RawMessage) (filter, bool) {
+	var def filterDef
+	if err := json.Unmarshal(raw, &def); err != nil {
+		l.diag(types.Diagnostic{Code: types.DiagParsingRuleFilter, RuleID: ruleID, Message: err.Error()})
+		return filter{}, false
+	}
+	if len(def.Targets) == 0 {
+		l.diag(types.Diagnostic{Code: types.DiagParsingRuleFilter, RuleID: ruleID, Message: "missing filter targets"})
+		return filter{}, false
+	}
+
+	op, err := newOperator(def.Operator, def.Value, def.Options)
+	if err != nil {
+		l.diag(types.Diagnostic{Code: types.DiagOperatorValue, RuleID: ruleID, Message: err.Error()})
+		return filter{}, false
+	}
+
+	f := filter{operator: op, targets: make([]target, len(def.Targets))}
+	for i, key := range def.Targets {
+		f.targets[i] = l.target(key)
+	}
+	return f, true
+}
+
+// target returns the target of the given manifest key. Keys missing from the
+// manifest are considered to be addresses of values to run on.
+func (l *loader) target(key string) target {
+	entry, ok := l.manifest[key]
+	if !ok {
+		return target{key: key, address: key, runOnValue: true}
+	}
+	t := target{
+		key:        key,
+		address:    entry.InheritFrom,
+		runOnValue: entry.RunOnValue == nil || *entry.RunOnValue,
+		runOnKey:   entry.RunOnKey,
+	}
+	if t.address == "" {
+		t.address = key
+	}
+	return t
+}
+
+func (l *loader) loadFlow(raw json.RawMessage) (flow, bool) {
+	var def flowDef
+	if err := json.Unmarshal(raw, &def); err != nil || def.Name == "" || len(def.Steps) == 0 {
+		msg := "missing flow name or steps"
+		if err != nil {
+			msg = err.Error()
+		}
+		l.diag(types.Diagnostic{Code: types.DiagParsingFlow, FlowName: def.Name, Message: msg})
+		return flow{}, false
+	}
+
+	steps := make([]stepDef, 0, len(def.Steps))
+	stepIndexes := make(map[string]int, len(def.Steps))
+	for _, raw := range def.Steps {
+		var s stepDef
+		if err := json.Unmarshal(raw, &s); err != nil || s.ID == "" || s.OnMatch == "" {
+			msg := "missing step id or on_match"
+			if err != nil {
+				msg = err.Error()
+			}
+			l.diag(types.Diagnostic{Code: types.DiagParsingFlowStep, FlowName: def.Name, StepID: s.ID, Message: msg})
+			return flow{}, false
+		}
+		if _, exists := stepIndexes[s.ID]; exists {
+			l.diag(types.Diagnostic{Code: types.DiagDuplicateFlowStep, FlowName: def.Name, StepID: s.ID})
+			return flow{}, false
+		}
+		stepIndexes[s.ID] = len(steps)
+		steps = append(steps, s)
+	}
+
+	f := flow{name: def.Name, steps: make([]step, len(steps))}
+	for i, s := range steps {
+		compiled := step{id: s.ID, rules: make([]*rule, 0, len(s.RuleIDs))}
+		for _, id := range s.RuleIDs {
+			r, ok := l.rules[id]
+			if !ok {
+				l.diag(types.Diagnostic{Code: types.DiagStepHasInvalidRule, FlowName: def.Name, StepID: s.ID, RuleID: id})
+				return flow{}, false
+			}
+			compiled.rules = append(compiled.rules, r)
+		}
+		if len(compiled.rules) == 0 {
+			l.diag(types.Diagnostic{Code: types.DiagMeaninglessStep, FlowName: def.Name, StepID: s.ID, Message: "no rules"})
+			return flow{}, false
+		}
+
+		var err error
+		if compiled.onMatch, err = newTransition(s.OnMatch, i, stepIndexes); err != nil {
+			l.diag(types.Diagnostic{Code: types.DiagMeaninglessStep, FlowName: def.Name, StepID: s.ID, Message: err.Error()})
+			return flow{}, false
+		}
+		if s.OnNoMatch == "" {
+			// Continue with the next step by default
+			compiled.onNoMatch = transition{next: i + 1, exit: i+1 == len(steps)}
+		} else if compiled.onNoMatch, err = newTransition(s.OnNoMatch, i, stepIndexes); err != nil {
+			l.diag(types.Diagnostic{Code: types.DiagMeaninglessStep, FlowName: def.Name, StepID: s.ID, Message: err.Error()})
+			return flow{}, false
+		}
+		f.steps[i] = compiled
+	}
+	return f, true
+}
+
+// newTransition returns the transition of the given step target, which is
+// either an exit action, or the id of a following step. Going back to previous
+// steps is not allowed in order to avoid loops.
+func newTransition(to string, current int, stepIndexes map[string]int) (transition, error) {
+	switch to {
+	case exitMonitor:
+		return transition{exit: true, action: types.MonitorAction}, nil
+	case exitBlock:
+		return transition{exit: true, action: types.BlockAction}, nil
+	}
+	next, ok := stepIndexes[to]
+	if !ok {
+		return transition{}, fmt.Errorf("unknown step `%s`", to)
+	}
+	if next <= current {
+		return transition{}, fmt.Errorf("step `%s` is not a following step", to)
+	}
+	return transition{next: next}, nil
+}
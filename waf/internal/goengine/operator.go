@@ -0,0 +1,178 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package goengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// operator of a rule filter.
+type operator interface {
+	// name of the operator, as found in the rule.
+	name() string
+	// value of the operator, as reported in the match report.
+	value() interface{}
+	// match returns the part of the given string that matched.
+	match(s string) (matched string, ok bool)
+}
+
+type operatorOptions struct {
+	CaseSensitive *bool `json:"case_sensitive"`
+	MinLength     int   `json:"min_length"`
+}
+
+func (o operatorOptions) caseSensitive() bool {
+	return o.CaseSensitive == nil || *o.CaseSensitive
+}
+
+// newOperator returns the operator of the given name and JSON value.
+func newOperator(name string, rawValue json.RawMessage, options operatorOptions) (operator, error) {
+	if name == "@pm" {
+		var list []string
+		if err := json.Unmarshal(rawValue, &list); err != nil {
+			var str string
+			if err := json.Unmarshal(rawValue, &str); err != nil {
+				return nil, fmt.Errorf("operator `%s` expects a string or a list of strings", name)
+			}
+			list = []string{str}
+		}
+		if len(list) == 0 {
+			return nil, fmt.Errorf("operator `%s` expects a non-empty list", name)
+		}
+		return newPhraseMatchOperator(list, options), nil
+	}
+
+	var str string
+	if err := json.Unmarshal(rawValue, &str); err != nil {
+		return nil, fmt.Errorf("operator `%s` expects a string value", name)
+	}
+
+	if name == "@rx" {
+		return newRegexpOperator(str, options)
+	}
+
+	var match func(s, value string) bool
+	switch name {
+	case "@contains":
+		match = strings.Contains
+	case "@beginsWith":
+		match = strings.HasPrefix
+	case "@endsWith":
+		match = strings.HasSuffix
+	case "@eq":
+		match = func(s, value string) bool { return s == value }
+	default:
+		return nil, fmt.Errorf("unknown operator `%s`", name)
+	}
+	return &stringOperator{
+		operatorName:  name,
+		operatorValue: str,
+		options:       options,
+		matchFunc:     match,
+	}, nil
+}
+
+type regexpOperator struct {
+	expr    string
+	re      *regexp.Regexp
+	options operatorOptions
+}
+
+func newRegexpOperator(expr string, options operatorOptions) (*regexpOperator, error) {
+	pattern := expr
+	if !options.caseSensitive() {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &regexpOperator{expr: expr, re: re, options: options}, nil
+}
+
+func (o *regexpOperator) name() string       { return "@rx" }
+func (o *regexpOperator) value() interface{} { return o.expr }
+
+func (o *regexpOperator) match(s string) (string, bool) {
+	if len(s) < o.options.MinLength {
+		return "", false
+	}
+	loc := o.re.FindStringIndex(s)
+	if loc == nil {
+		return "", false
+	}
+	return s[loc[0]:loc[1]], true
+}
+
+type phraseMatchOperator struct {
+	phrases []string
+	// Phrases in the case they are compared
+	compared []string
+	options  operatorOptions
+}
+
+func newPhraseMatchOperator(phrases []string, options operatorOptions) *phraseMatchOperator {
+	compared := phrases
+	if !options.caseSensitive() {
+		compared = make([]string, len(phrases))
+		for i, p := range phrases {
+			compared[i] = strings.ToLower(p)
+		}
+	}
+	return &phraseMatchOperator{phrases: phrases, compared: compared, options: options}
+}
+
+func (o *phraseMatchOperator) name() string       { return "@pm" }
+func (o *phraseMatchOperator) value() interface{} { return o.phrases }
+
+func (o *phraseMatchOperator) match(s string) (string, bool) {
+	if len(s) < o.options.MinLength {
+		return "", false
+	}
+	compared := s
+	if !o.options.caseSensitive() {
+		compared = strings.ToLower(s)
+	}
+	for j, p := range o.compared {
+		i := strings.Index(compared, p)
+		if i < 0 {
+			continue
+		}
+		if len(compared) != len(s) {
+			// Lowering the case changed the byte offsets
+			return o.phrases[j], true
+		}
+		return s[i : i+len(p)], true
+	}
+	return "", false
+}
+
+// stringOperator is an operator comparing strings.
+type stringOperator struct {
+	operatorName  string
+	operatorValue string
+	options       operatorOptions
+	matchFunc     func(s, value string) bool
+}
+
+func (o *stringOperator) name() string       { return o.operatorName }
+func (o *stringOperator) value() interface{} { return o.operatorValue }
+
+func (o *stringOperator) match(s string) (string, bool) {
+	if len(s) < o.options.MinLength {
+		return "", false
+	}
+	value := o.operatorValue
+	if !o.options.caseSensitive() {
+		s, value = strings.ToLower(s), strings.ToLower(value)
+	}
+	if !o.matchFunc(s, value) {
+		return "", false
+	}
+	return o.operatorValue, true
+}
@@ -0,0 +1,439 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// Package goengine is a pure-Go implementation of the WAF rules, used when the
+// native library is not available. It understands the same JSON rule format
+// and returns the same match report format as the native library, for a
+// subset of its operators: `@rx`, `@pm`, `@contains`, `@beginsWith`,
+// `@endsWith` and `@eq`.
+package goengine
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/leaks"
+	"github.com/sqreen/go-libsqreen/waf/internal/marshal"
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// Default time budget of a run with a context having no deadline, the same as
+// the native library.
+const defaultRunTimeout = 5 * time.Millisecond
+
+// Static assert that the function have the expected signatures
+var (
+	_ types.NewRuleWithConfigFunc           = NewRule
+	_ types.NewAdditiveContextFunc          = NewAdditiveContext
+	_ types.NewAdditiveContextWithErrorFunc = NewAdditiveContextWithError
+)
+
+// Static assert that the types implement the rule interfaces
+var (
+	_ types.Rule          = (*Rule)(nil)
+	_ types.Rule          = (*AdditiveContext)(nil)
+	_ types.ResultRunner  = (*Rule)(nil)
+	_ types.ResultRunner  = (*AdditiveContext)(nil)
+	_ types.ContextRunner = (*Rule)(nil)
+	_ types.ContextRunner = (*AdditiveContext)(nil)
+)
+
+type Rule struct {
+	flows   []flow
+	encoder marshal.Encoder
+	closed  int32
+	// Leak tracking entry, nil when not tracked
+	leak *leaks.Object
+}
+
+// NewRule compiles the given JSON rule. Invalid rules and flows are ignored
+// and reported in the returned diagnostics, while an invalid JSON document
+// returns an *types.InvalidRuleError.
+func NewRule(ruleFile string, config types.Config) (types.Rule, types.Diagnostics, error) {
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	flows, diags, err := load(ruleFile)
+	if err != nil {
+		return nil, diags, err
+	}
+	r := &Rule{
+		flows:   flows,
+		encoder: marshal.NewEncoder(config.WithDefaults()),
+	}
+	r.leak = leaks.Track(r, types.ObjectRule, types.EngineGo)
+	return r, diags, nil
+}
+
+func (r *Rule) Run(data types.DataSet, timeout time.Duration) (action types.Action, info []byte, err error) {
+	res, err := r.RunWithResult(data, timeout)
+	return res.Action, res.Data, err
+}
+
+// RunWithResult runs the rule, or returns types.ErrRuleClosed once closed.
+func (r *Rule) RunWithResult(data types.DataSet, timeout time.Duration) (types.Result, error) {
+	if r.isClosed() {
+		return types.Result{}, types.ErrRuleClosed
+	}
+	return r.run(context.Background(), nil, data, timeout, false)
+}
+
+func (r *Rule) RunContext(ctx context.Context, data types.DataSet) (action types.Action, info []byte, err error) {
+	if r.isClosed() {
+		return types.NoAction, nil, types.ErrRuleClosed
+	}
+	res, err := r.run(ctx, nil, data, defaultRunTimeout, true)
+	return res.Action, res.Data, err
+}
+
+// Close the rule. It can no longer be run nor used to create additive
+// contexts, while the existing ones can continue using it.
+func (r *Rule) Close() error {
+	if atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		r.leak.Untrack(r)
+	}
+	return nil
+}
+
+func (r *Rule) isClosed() bool {
+	return atomic.LoadInt32(&r.closed) != 0
+}
+
+// run the rule on the data set, merged into the previous values when not nil.
+// The timeout includes the encoding time when withEncoding is true.
+func (r *Rule) run(ctx context.Context, previous map[string]value, data types.DataSet, timeout time.Duration, withEncoding bool) (res types.Result, err error) {
+	values, res, err := r.encode(ctx, data)
+	if err != nil {
+		return res, err
+	}
+
+	var spent time.Duration
+	if withEncoding {
+		spent = res.EncodingTime
+	}
+	timeout, err = runTimeout(ctx, timeout, spent)
+	if err != nil {
+		return res, err
+	}
+	start := time.Now()
+	defer func() {
+		res.TotalRuntime = time.Since(start)
+	}()
+	if timeout <= 0 {
+		return res, types.ErrTimeout
+	}
+
+	// Merge the values only once the run starts, so that the runs failing
+	// before it do not alter the additive context, as with the native engine.
+	if previous != nil {
+		for k, v := range values {
+			previous[k] = v
+		}
+		values = previous
+	}
+
+	e := evaluator{values: values, deadline: start.Add(timeout)}
+	res.Action, res.Data, err = e.run(r.flows)
+	return res, err
+}
+
+// encode the data set.
+func (r *Rule) encode(ctx context.Context, data types.DataSet) (map[string]value, types.Result, error) {
+	var res types.Result
+	if err := ctx.Err(); err != nil {
+		return nil, res, err
+	}
+
+	start := time.Now()
+	var s valueSink
+	nbValues, stats, err := r.encoder.Encode(data, &s)
+	res.EncodingTime = time.Since(start)
+	res.EncodedValues = nbValues
+	res.EncodeStats = stats
+	if err != nil {
+		return nil, res, err
+	}
+	// Map of the addresses to their value
+	values := make(map[string]value, len(s.v.keys))
+	for i, k := range s.v.keys {
+		values[k] = s.v.elements[i]
+	}
+	return values, res, nil
+}
+
+// runTimeout returns the time budget of a run. It is the time left until the
+// context deadline, if any, or the given timeout minus the time already spent
+// otherwise. The context error is returned when it is done.
+func runTimeout(ctx context.Context, timeout, spent time.Duration) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return 0, context.DeadlineExceeded
+		}
+		return timeout, nil
+	}
+	return timeout - spent, nil
+}
+
+// AdditiveContext runs the rule on the values accumulated across its runs,
+// values of an address being replaced by the latest ones.
+type AdditiveContext struct {
+	rule   *Rule
+	mu     sync.Mutex
+	values map[string]value
+	// Leak tracking entry, nil when not tracked
+	leak *leaks.Object
+}
+
+// NewAdditiveContext returns a new additive context of the rule, or nil when
+// it is not a rule of this engine or it was closed.
+func NewAdditiveContext(r types.Rule) types.Rule {
+	ctx, _ := NewAdditiveContextWithError(r)
+	if ctx == nil {
+		return nil
+	}
+	return ctx
+}
+
+// NewAdditiveContextWithError returns a new additive context of the rule. The
+// returned error is types.ErrIncompatibleRule when the rule is not a rule of
+// this engine, and types.ErrRuleClosed when it was closed.
+func NewAdditiveContextWithError(r types.Rule) (types.Rule, error) {
+	rule, _ := r.(*Rule)
+	if rule == nil {
+		return nil, types.ErrIncompatibleRule
+	}
+	if rule.isClosed() {
+		return nil, types.ErrRuleClosed
+	}
+	c := &AdditiveContext{
+		rule:   rule,
+		values: make(map[string]value),
+	}
+	c.leak = leaks.Track(c, types.ObjectAdditiveContext, types.EngineGo)
+	return c, nil
+}
+
+func (c *AdditiveContext) Run(data types.DataSet, timeout time.Duration) (action types.Action, info []byte, err error) {
+	res, err := c.RunWithResult(data, timeout)
+	return res.Action, res.Data, err
+}
+
+func (c *AdditiveContext) RunWithResult(data types.DataSet, timeout time.Duration) (types.Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed() {
+		return types.Result{}, types.ErrContextClosed
+	}
+	return c.rule.run(context.Background(), c.values, data, timeout, false)
+}
+
+func (c *AdditiveContext) RunContext(ctx context.Context, data types.DataSet) (action types.Action, info []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed() {
+		return types.NoAction, nil, types.ErrContextClosed
+	}
+	res, err := c.rule.run(ctx, c.values, data, defaultRunTimeout, true)
+	return res.Action, res.Data, err
+}
+
+// Close the additive context. Closing it again has no effect, and runs then
+// return types.ErrContextClosed.
+func (c *AdditiveContext) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isClosed() {
+		c.leak.Untrack(c)
+	}
+	c.values = nil
+	return nil
+}
+
+// isClosed returns true once closed. The caller must hold the lock.
+func (c *AdditiveContext) isClosed() bool {
+	return c.values == nil
+}
+
+// evaluator runs the flows on the values and builds the match report.
+type evaluator struct {
+	values   map[string]value
+	deadline time.Time
+	// Results of the rules already evaluated
+	matches map[*rule][]filterReport
+}
+
+// Match report entry of a flow, in the same format as the native library.
+type (
+	flowReport struct {
+		RetCode int            `json:"ret_code"`
+		Flow    string         `json:"flow"`
+		Step    string         `json:"step"`
+		Rule    string         `json:"rule"`
+		Filter  []filterReport `json:"filter"`
+	}
+
+	filterReport struct {
+		Operator        string        `json:"operator"`
+		OperatorValue   interface{}   `json:"operator_value"`
+		BindingAccessor string        `json:"binding_accessor"`
+		ManifestKey     string        `json:"manifest_key"`
+		KeyPath         []interface{} `json:"key_path"`
+		ResolvedValue   string        `json:"resolved_value"`
+		MatchStatus     string        `json:"match_status"`
+	}
+)
+
+func (e *evaluator) run(flows []flow) (action types.Action, info []byte, err error) {
+	e.matches = make(map[*rule][]filterReport)
+	var reports []flowReport
+	for i := range flows {
+		report, ok, err := e.runFlow(&flows[i])
+		if err != nil {
+			return types.NoAction, nil, err
+		}
+		if !ok {
+			continue
+		}
+		reports = append(reports, report)
+		if a := types.Action(report.RetCode); a > action {
+			action = a
+		}
+	}
+	if len(reports) == 0 {
+		return types.NoAction, nil, nil
+	}
+	info, err = json.Marshal(reports)
+	if err != nil {
+		return types.NoAction, nil, types.ErrInternal
+	}
+	return action, info, nil
+}
+
+// runFlow returns the report of the flow when it exited with an action.
+func (e *evaluator) runFlow(f *flow) (report flowReport, ok bool, err error) {
+	for i := 0; i < len(f.steps); {
+		s := &f.steps[i]
+		var (
+			matched *rule
+			filters []filterReport
+		)
+		for _, r := range s.rules {
+			if filters, err = e.runRule(r); err != nil {
+				return report, false, err
+			}
+			if filters != nil {
+				matched = r
+				break
+			}
+		}
+
+		t := s.onNoMatch
+		if matched != nil {
+			t = s.onMatch
+		}
+		if !t.exit {
+			i = t.next
+			continue
+		}
+		if matched == nil || t.action == types.NoAction {
+			return report, false, nil
+		}
+		return flowReport{
+			RetCode: int(t.action),
+			Flow:    f.name,
+			Step:    s.id,
+			Rule:    matched.id,
+			Filter:  filters,
+		}, true, nil
+	}
+	return report, false, nil
+}
+
+// runRule returns the filter matches of the rule, or nil when it doesn't
+// match. The rule matches when every filter matches.
+func (e *evaluator) runRule(r *rule) ([]filterReport, error) {
+	if filters, evaluated := e.matches[r]; evaluated {
+		return filters, nil
+	}
+	if time.Now().After(e.deadline) {
+		return nil, types.ErrTimeout
+	}
+
+	filters := make([]filterReport, 0, len(r.filters))
+	for i := range r.filters {
+		report, ok := e.runFilter(&r.filters[i])
+		if !ok {
+			filters = nil
+			break
+		}
+		filters = append(filters, report)
+	}
+	e.matches[r] = filters
+	return filters, nil
+}
+
+func (e *evaluator) runFilter(f *filter) (report filterReport, ok bool) {
+	for _, t := range f.targets {
+		v, exists := e.values[t.address]
+		if !exists {
+			continue
+		}
+		path := make([]interface{}, 0, 4)
+		resolved, matched, path, ok := matchValue(f.operator, t, v, path)
+		if !ok {
+			continue
+		}
+		return filterReport{
+			Operator:        f.operator.name(),
+			OperatorValue:   f.operator.value(),
+			BindingAccessor: t.address,
+			ManifestKey:     t.key,
+			KeyPath:         path,
+			ResolvedValue:   resolved,
+			MatchStatus:     matched,
+		}, true
+	}
+	return filterReport{}, false
+}
+
+// matchValue walks the value and returns the first string matching the
+// operator, along with the path of keys and indexes leading to it.
+func matchValue(op operator, t target, v value, path []interface{}) (resolved, matched string, _ []interface{}, ok bool) {
+	switch v.kind {
+	case stringValue:
+		if !t.runOnValue {
+			return "", "", path, false
+		}
+		matched, ok := op.match(v.str)
+		return v.str, matched, path, ok
+
+	case arrayValue:
+		for i, elt := range v.elements {
+			if resolved, matched, p, ok := matchValue(op, t, elt, append(path, i)); ok {
+				return resolved, matched, p, true
+			}
+		}
+
+	case mapValue:
+		for i, elt := range v.elements {
+			key := v.keys[i]
+			if t.runOnKey {
+				if matched, ok := op.match(key); ok {
+					return key, matched, append(path, key), true
+				}
+			}
+			if resolved, matched, p, ok := matchValue(op, t, elt, append(path, key)); ok {
+				return resolved, matched, p, true
+			}
+		}
+	}
+	return "", "", path, false
+}
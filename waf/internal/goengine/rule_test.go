@@ -0,0 +1,233 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package goengine_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/goengine"
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+// newRuleFile returns a rule file having a single flow blocking the matches of
+// the given filter on the `args` address.
+func newRuleFile(operator string, value interface{}, options string) string {
+	v, _ := json.Marshal(value)
+	if options == "" {
+		options = "{}"
+	}
+	return fmt.Sprintf(`{
+  "manifest": { "args": { "inherit_from": "args", "run_on_value": true, "run_on_key": true } },
+  "rules": [ { "rule_id": "1", "filters": [ { "operator": "%s", "targets": ["args"], "value": %s, "options": %s } ] } ],
+  "flows": [ { "name": "flow", "steps": [ { "id": "start", "rule_ids": ["1"], "on_match": "exit_block" } ] } ]
+}`, operator, v, options)
+}
+
+func TestOperators(t *testing.T) {
+	for _, tc := range []struct {
+		operator  string
+		value     interface{}
+		options   string
+		data      interface{}
+		matched   string
+		noMatches []interface{}
+	}{
+		{operator: "@rx", value: "a+b", data: "xaaab", matched: "aaab", noMatches: []interface{}{"b", "AB"}},
+		{operator: "@rx", value: "a+b", options: `{"case_sensitive": false}`, data: "xAAB", matched: "AAB"},
+		{operator: "@rx", value: "a+b", options: `{"min_length": 5}`, data: "xaaab", matched: "aaab", noMatches: []interface{}{"xab"}},
+		{operator: "@pm", value: []string{"foo", "bar"}, data: "a bar", matched: "bar", noMatches: []interface{}{"baz"}},
+		{operator: "@pm", value: "foo", options: `{"case_sensitive": false}`, data: "FOO", matched: "FOO"},
+		{operator: "@contains", value: "oo", data: "foo", matched: "oo", noMatches: []interface{}{"fo"}},
+		{operator: "@beginsWith", value: "fo", data: "foo", matched: "fo", noMatches: []interface{}{"oof"}},
+		{operator: "@endsWith", value: "oo", data: "foo", matched: "oo", noMatches: []interface{}{"oof"}},
+		{operator: "@eq", value: "foo", data: "foo", matched: "foo", noMatches: []interface{}{"fooo"}},
+		{operator: "@eq", value: "33", data: 33, matched: "33", noMatches: []interface{}{34}},
+		{operator: "@eq", value: "key", data: map[string]int{"key": 1}, matched: "key", noMatches: []interface{}{map[string]string{"other": "value"}}},
+	} {
+		tc := tc
+		t.Run(tc.operator, func(t *testing.T) {
+			r, diags, err := goengine.NewRule(newRuleFile(tc.operator, tc.value, tc.options), types.Config{})
+			require.NoError(t, err)
+			require.Empty(t, diags)
+			defer r.Close()
+
+			action, info, err := r.Run(types.DataSet{"args": tc.data}, time.Second)
+			require.NoError(t, err)
+			require.Equal(t, types.BlockAction, action)
+			var report []struct {
+				RetCode int    `json:"ret_code"`
+				Flow    string `json:"flow"`
+				Step    string `json:"step"`
+				Rule    string `json:"rule"`
+				Filter  []struct {
+					Operator    string `json:"operator"`
+					MatchStatus string `json:"match_status"`
+				} `json:"filter"`
+			}
+			require.NoError(t, json.Unmarshal(info, &report))
+			require.Len(t, report, 1)
+			require.Equal(t, 2, report[0].RetCode)
+			require.Equal(t, "flow", report[0].Flow)
+			require.Equal(t, "start", report[0].Step)
+			require.Equal(t, "1", report[0].Rule)
+			require.Len(t, report[0].Filter, 1)
+			require.Equal(t, tc.operator, report[0].Filter[0].Operator)
+			require.Equal(t, tc.matched, report[0].Filter[0].MatchStatus)
+
+			for _, data := range tc.noMatches {
+				action, info, err := r.Run(types.DataSet{"args": data}, time.Second)
+				require.NoError(t, err)
+				require.Equal(t, types.NoAction, action)
+				require.Empty(t, info)
+			}
+		})
+	}
+}
+
+func TestFlows(t *testing.T) {
+	r, diags, err := goengine.NewRule(`{
+  "rules": [
+    { "rule_id": "sqli", "filters": [ { "operator": "@contains", "targets": ["query"], "value": "' OR 1=1" } ] },
+    { "rule_id": "admin", "filters": [ { "operator": "@beginsWith", "targets": ["path"], "value": "/admin" } ] },
+    { "rule_id": "both", "filters": [
+      { "operator": "@eq", "targets": ["path"], "value": "/login" },
+      { "operator": "@pm", "targets": ["query"], "value": ["select", "union"] }
+    ] }
+  ],
+  "flows": [
+    { "name": "sqli", "steps": [
+      { "id": "admin", "rule_ids": ["admin"], "on_match": "detect", "on_no_match": "exit_monitor" },
+      { "id": "detect", "rule_ids": ["sqli", "both"], "on_match": "exit_block" }
+    ] },
+    { "name": "login", "steps": [
+      { "id": "start", "rule_ids": ["both"], "on_match": "exit_monitor" }
+    ] }
+  ]
+}`, types.Config{})
+	require.NoError(t, err)
+	require.Empty(t, diags)
+	defer r.Close()
+
+	for _, tc := range []struct {
+		data   types.DataSet
+		action types.Action
+		flows  []string
+	}{
+		{data: types.DataSet{"path": "/admin/users", "query": "' OR 1=1"}, action: types.BlockAction, flows: []string{"sqli"}},
+		{data: types.DataSet{"path": "/admin/users", "query": "id=1"}, action: types.NoAction},
+		{data: types.DataSet{"path": "/", "query": "' OR 1=1"}, action: types.NoAction},
+		{data: types.DataSet{"path": "/login", "query": []string{"a", "union"}}, action: types.MonitorAction, flows: []string{"login"}},
+	} {
+		action, info, err := r.Run(tc.data, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, tc.action, action)
+		if tc.action == types.NoAction {
+			require.Empty(t, info)
+			continue
+		}
+		var report []struct {
+			Flow string `json:"flow"`
+		}
+		require.NoError(t, json.Unmarshal(info, &report))
+		flows := make([]string, len(report))
+		for i, e := range report {
+			flows[i] = e.Flow
+		}
+		require.Equal(t, tc.flows, flows)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	r, diags, err := goengine.NewRule(`{ oops`, types.Config{})
+	require.Nil(t, r)
+	require.IsType(t, &types.InvalidRuleError{}, err)
+	require.Len(t, diags, 1)
+	require.Equal(t, types.DiagParsingJSON, diags[0].Code)
+
+	r, diags, err = goengine.NewRule(`{
+  "rules": [
+    { "rule_id": "1", "filters": [ { "operator": "@rx", "targets": ["a"], "value": "(" } ] },
+    { "rule_id": "2", "filters": [ { "operator": "@unknown", "targets": ["a"], "value": "b" } ] },
+    { "rule_id": "3", "filters": [ { "operator": "@eq", "targets": ["a"], "value": "b" } ] },
+    { "rule_id": "3", "filters": [ { "operator": "@eq", "targets": ["a"], "value": "c" } ] }
+  ],
+  "flows": [
+    { "name": "invalid", "steps": [ { "id": "start", "rule_ids": ["1"], "on_match": "exit_block" } ] },
+    { "name": "loop", "steps": [
+      { "id": "start", "rule_ids": ["3"], "on_match": "next" },
+      { "id": "next", "rule_ids": ["3"], "on_match": "start" }
+    ] },
+    { "name": "valid", "steps": [ { "id": "start", "rule_ids": ["3"], "on_match": "exit_block" } ] },
+    { "name": "valid", "steps": [ { "id": "start", "rule_ids": ["3"], "on_match": "exit_monitor" } ] }
+  ]
+}`, types.Config{})
+	require.NoError(t, err)
+	defer r.Close()
+	codes := make([]types.DiagnosticCode, len(diags))
+	for i, d := range diags {
+		codes[i] = d.Code
+	}
+	require.Equal(t, []types.DiagnosticCode{
+		types.DiagOperatorValue,
+		types.DiagOperatorValue,
+		types.DiagDuplicateRule,
+		types.DiagStepHasInvalidRule,
+		types.DiagMeaninglessStep,
+		types.DiagDuplicateFlow,
+	}, codes)
+
+	// Only the first valid flow is kept
+	action, _, err := r.Run(types.DataSet{"a": "b"}, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, types.BlockAction, action)
+
+	_, _, err = goengine.NewRule(`{}`, types.Config{MaxMapLength: -1})
+	require.Error(t, err)
+}
+
+func TestAdditiveContext(t *testing.T) {
+	r, _, err := goengine.NewRule(`{
+  "rules": [ { "rule_id": "1", "filters": [
+    { "operator": "@eq", "targets": ["a"], "value": "1" },
+    { "operator": "@eq", "targets": ["b"], "value": "2" }
+  ] } ],
+  "flows": [ { "name": "flow", "steps": [ { "id": "start", "rule_ids": ["1"], "on_match": "exit_block" } ] } ]
+}`, types.Config{})
+	require.NoError(t, err)
+
+	require.Nil(t, goengine.NewAdditiveContext(nil))
+	ctx := goengine.NewAdditiveContext(r)
+	require.NotNil(t, ctx)
+	defer ctx.Close()
+
+	// Runs failing before they start do not keep their values
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = ctx.(types.ContextRunner).RunContext(canceled, types.DataSet{"a": "1"})
+	require.Equal(t, context.Canceled, err)
+	action, _, err := ctx.Run(types.DataSet{"b": "2"}, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, types.NoAction, action)
+
+	action, _, err = ctx.Run(types.DataSet{"a": "1"}, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, types.BlockAction, action)
+	// Replacing a value
+	action, _, err = ctx.Run(types.DataSet{"a": "3"}, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, types.NoAction, action)
+
+	// Existing contexts keep working once the rule is closed
+	require.NoError(t, r.Close())
+	require.Nil(t, goengine.NewAdditiveContext(r))
+	action, _, err = ctx.Run(types.DataSet{"a": "1"}, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, types.BlockAction, action)
+}
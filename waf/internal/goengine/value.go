@@ -0,0 +1,92 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package goengine
+
+import (
+	"strconv"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/marshal"
+)
+
+type valueKind int
+
+const (
+	stringValue valueKind = iota
+	arrayValue
+	mapValue
+)
+
+// value is the Go representation of a WAF value. Numbers are represented as
+// strings, as the native WAF does.
+type value struct {
+	kind valueKind
+	str  string
+	// Array elements or map values
+	elements []value
+	// Map keys, having the same length as elements
+	keys []string
+}
+
+// Static assert that the sink implements its interface
+var _ marshal.Sink = (*valueSink)(nil)
+
+// valueSink builds the values emitted by the encoder.
+type valueSink struct {
+	// Containers being built, the innermost last
+	containers []value
+	// The encoded value
+	v value
+}
+
+func (s *valueSink) String(key, str string) error {
+	s.add(key, value{kind: stringValue, str: str})
+	return nil
+}
+
+func (s *valueSink) Int(key string, n int64) error {
+	return s.String(key, strconv.FormatInt(n, 10))
+}
+
+func (s *valueSink) Uint(key string, n uint64) error {
+	return s.String(key, strconv.FormatUint(n, 10))
+}
+
+func (s *valueSink) Start(isMap bool) {
+	kind := arrayValue
+	if isMap {
+		kind = mapValue
+	}
+	s.containers = append(s.containers, value{kind: kind})
+}
+
+func (s *valueSink) End(key string) error {
+	s.add(key, s.pop())
+	return nil
+}
+
+func (s *valueSink) Discard() {
+	s.pop()
+}
+
+func (s *valueSink) pop() value {
+	last := len(s.containers) - 1
+	v := s.containers[last]
+	s.containers = s.containers[:last]
+	return v
+}
+
+// add the value to the innermost container, or set it as the encoded value
+// when there is none.
+func (s *valueSink) add(key string, v value) {
+	if len(s.containers) == 0 {
+		s.v = v
+		return
+	}
+	c := &s.containers[len(s.containers)-1]
+	if c.kind == mapValue {
+		c.keys = append(c.keys, key)
+	}
+	c.elements = append(c.elements, v)
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// Package leaks implements the leak tracking debug mode of the rules and
+// additive contexts of the WAF engines. When enabled, the objects are tracked
+// from their creation until they are closed, and finalizers report the ones
+// garbage collected without being closed.
+package leaks
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// Maximum number of stack frames of the creation stack traces
+const maxStackDepth = 32
+
+var tracker struct {
+	// Fast path of Track when disabled
+	enabled int32
+	mu      sync.Mutex
+	config  types.LeakTrackingConfig
+	lastID  uint64
+	// Tracked objects, nil when disabled
+	objects map[*Object]struct{}
+}
+
+// Enable the leak tracking of the objects created from now on with the given
+// configuration. The objects already tracked remain tracked with the new
+// configuration.
+func Enable(config types.LeakTrackingConfig) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	tracker.config = config
+	if tracker.objects == nil {
+		tracker.objects = make(map[*Object]struct{})
+	}
+	atomic.StoreInt32(&tracker.enabled, 1)
+}
+
+// Disable the leak tracking and forget the tracked objects. Their finalizers
+// cannot be cleared as the tracker does not reference them, which would
+// prevent their garbage collection. The finalizers therefore remain until the
+// objects are closed or garbage collected, but no longer report anything.
+func Disable() {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	atomic.StoreInt32(&tracker.enabled, 0)
+	tracker.config = types.LeakTrackingConfig{}
+	tracker.objects = nil
+}
+
+// LiveObjects returns the tracked objects not closed yet, in creation order.
+func LiveObjects() []types.LiveObject {
+	tracker.mu.Lock()
+	objects := make([]types.LiveObject, 0, len(tracker.objects))
+	for o := range tracker.objects {
+		objects = append(objects, o.info)
+	}
+	tracker.mu.Unlock()
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].ID < objects[j].ID
+	})
+	return objects
+}
+
+// Object is the tracking entry of an object. A nil *Object is an untracked
+// object.
+type Object struct {
+	info types.LiveObject
+}
+
+// Track the object, which must be a pointer to the rule or additive context,
+// until it is untracked when closed. nil is returned when the leak tracking is
+// disabled. The object finalizer is used to detect leaks, so the object must
+// not have another one.
+func Track(obj io.Closer, kind types.ObjectKind, engine types.Engine) *Object {
+	if atomic.LoadInt32(&tracker.enabled) == 0 {
+		return nil
+	}
+
+	o := &Object{
+		info: types.LiveObject{
+			Kind:    kind,
+			Engine:  engine,
+			Created: time.Now(),
+			Stack:   stack(),
+		},
+	}
+
+	tracker.mu.Lock()
+	if tracker.objects == nil {
+		// Disabled in the meantime
+		tracker.mu.Unlock()
+		return nil
+	}
+	tracker.lastID++
+	o.info.ID = tracker.lastID
+	tracker.objects[o] = struct{}{}
+	tracker.mu.Unlock()
+
+	// The finalizer must not reference the object, which would otherwise never
+	// be garbage collected.
+	runtime.SetFinalizer(obj, func(obj io.Closer) {
+		o.finalize(obj)
+	})
+	return o
+}
+
+// Untrack the closed object. It can be called several times.
+func (o *Object) Untrack(obj io.Closer) {
+	if o == nil {
+		return
+	}
+	remove(o)
+	runtime.SetFinalizer(obj, nil)
+}
+
+// finalize reports the object garbage collected without being closed, and
+// closes it when configured so.
+func (o *Object) finalize(obj io.Closer) {
+	config, ok := remove(o)
+	if !ok {
+		// No longer tracked since the leak tracking was disabled
+		return
+	}
+	if config.OnLeak != nil {
+		config.OnLeak(o.info)
+	}
+	if config.Release {
+		obj.Close()
+	}
+}
+
+// remove the object from the tracked objects, and returns the configuration
+// along with whether it was tracked.
+func remove(o *Object) (types.LeakTrackingConfig, bool) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if _, ok := tracker.objects[o]; !ok {
+		return types.LeakTrackingConfig{}, false
+	}
+	delete(tracker.objects, o)
+	return tracker.config, true
+}
+
+// stack returns the stack trace of the caller of Track.
+func stack() string {
+	pc := make([]uintptr, maxStackDepth)
+	// Skip runtime.Callers, stack and Track
+	n := runtime.Callers(3, pc)
+	if n == 0 {
+		return ""
+	}
+	frames := runtime.CallersFrames(pc[:n])
+	var b strings.Builder
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
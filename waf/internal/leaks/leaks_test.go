@@ -0,0 +1,153 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package leaks_test
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/leaks"
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+type testObject struct {
+	// Make the object large enough not to be allocated by the tiny allocator,
+	// whose objects are not finalized individually.
+	_      [64]byte
+	closed *int32
+	leak   *leaks.Object
+}
+
+func newTestObject(kind types.ObjectKind, closed *int32) *testObject {
+	o := &testObject{closed: closed}
+	o.leak = leaks.Track(o, kind, types.EngineGo)
+	return o
+}
+
+func (o *testObject) Close() error {
+	atomic.AddInt32(o.closed, 1)
+	o.leak.Untrack(o)
+	return nil
+}
+
+// createLeaks creates objects that are never closed.
+func createLeaks(n int, closed *int32) {
+	for i := 0; i < n; i++ {
+		newTestObject(types.ObjectAdditiveContext, closed)
+	}
+}
+
+// waitLeaks runs the garbage collector until n leaks were reported.
+func waitLeaks(t *testing.T, leaked <-chan types.LiveObject, n int) []types.LiveObject {
+	var objects []types.LiveObject
+	deadline := time.Now().Add(10 * time.Second)
+	for len(objects) < n {
+		runtime.GC()
+		select {
+		case o := <-leaked:
+			objects = append(objects, o)
+		case <-time.After(10 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatalf("%d leaks reported out of %d", len(objects), n)
+			}
+		}
+	}
+	return objects
+}
+
+func TestLeaks(t *testing.T) {
+	defer leaks.Disable()
+
+	t.Run("disabled", func(t *testing.T) {
+		var closed int32
+		o := newTestObject(types.ObjectRule, &closed)
+		require.Nil(t, o.leak)
+		require.Empty(t, leaks.LiveObjects())
+		require.NoError(t, o.Close())
+	})
+
+	t.Run("live objects", func(t *testing.T) {
+		leaks.Enable(types.LeakTrackingConfig{})
+		defer leaks.Disable()
+
+		var closed int32
+		r := newTestObject(types.ObjectRule, &closed)
+		c := newTestObject(types.ObjectAdditiveContext, &closed)
+		objects := leaks.LiveObjects()
+		require.Len(t, objects, 2)
+		require.Equal(t, types.ObjectRule, objects[0].Kind)
+		require.Equal(t, types.ObjectAdditiveContext, objects[1].Kind)
+		require.True(t, objects[0].ID < objects[1].ID)
+		require.Equal(t, types.EngineGo, objects[0].Engine)
+		require.False(t, objects[0].Created.IsZero())
+		// The stack trace starts with the caller of Track
+		require.Contains(t, objects[0].Stack, "leaks_test.newTestObject")
+		require.Contains(t, objects[0].Stack, "leaks_test.TestLeaks")
+
+		require.NoError(t, r.Close())
+		require.NoError(t, r.Close())
+		objects = leaks.LiveObjects()
+		require.Len(t, objects, 1)
+		require.Equal(t, types.ObjectAdditiveContext, objects[0].Kind)
+
+		// Disabling forgets the objects
+		leaks.Disable()
+		require.Empty(t, leaks.LiveObjects())
+		require.NoError(t, c.Close())
+	})
+
+	t.Run("leaks", func(t *testing.T) {
+		for _, release := range []bool{false, true} {
+			leaked := make(chan types.LiveObject, 10)
+			leaks.Enable(types.LeakTrackingConfig{
+				OnLeak:  func(o types.LiveObject) { leaked <- o },
+				Release: release,
+			})
+
+			var closed int32
+			createLeaks(3, &closed)
+			objects := waitLeaks(t, leaked, 3)
+			for _, o := range objects {
+				require.Equal(t, types.ObjectAdditiveContext, o.Kind)
+				require.Contains(t, o.Stack, "leaks_test.createLeaks")
+			}
+			require.Empty(t, leaks.LiveObjects())
+			if release {
+				// Closed right after being reported
+				require.Eventually(t, func() bool {
+					return atomic.LoadInt32(&closed) == 3
+				}, 10*time.Second, time.Millisecond)
+			} else {
+				require.Equal(t, int32(0), atomic.LoadInt32(&closed))
+			}
+			leaks.Disable()
+		}
+	})
+
+	t.Run("leaks once disabled", func(t *testing.T) {
+		// The finalizers of the objects forgotten when disabling no longer
+		// report nor release them
+		var closed int32
+		leaks.Enable(types.LeakTrackingConfig{Release: true})
+		createLeaks(3, &closed)
+		leaks.Disable()
+
+		leaked := make(chan types.LiveObject, 10)
+		leaks.Enable(types.LeakTrackingConfig{
+			OnLeak: func(o types.LiveObject) { leaked <- o },
+		})
+		defer leaks.Disable()
+		var sentinelClosed int32
+		createLeaks(1, &sentinelClosed)
+		waitLeaks(t, leaked, 1)
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+		require.Empty(t, leaked)
+		require.Equal(t, int32(0), atomic.LoadInt32(&closed))
+	})
+}
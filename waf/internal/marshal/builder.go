@@ -0,0 +1,305 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal
+
+import (
+	"reflect"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// Static assert that the builders implement their interfaces
+var (
+	_ types.WAFBuilder      = (*builder)(nil)
+	_ types.WAFArrayBuilder = (*containerBuilder)(nil)
+	_ types.WAFMapBuilder   = (*containerBuilder)(nil)
+)
+
+// encodeEncodable encodes the value built by the types.WAFEncodable value. The
+// value is held until EncodeWAF returns so that it is not added when an error
+// is returned.
+func (e *Encoder) encodeEncodable(key string, enc types.WAFEncodable, depth int) error {
+	// Values delegating their value to themselves would recurse forever as
+	// the delegation is not accounted in the depth.
+	typ := reflect.TypeOf(enc)
+	var delegates []reflect.Type
+	if d := e.delegation; d != nil && d.level == e.open {
+		for _, t := range d.types {
+			if t == typ {
+				e.stats.Record(types.EncodeCycle, 1)
+				return ErrCycle
+			}
+		}
+		delegates = d.types[:len(d.types):len(d.types)]
+	}
+
+	b := builder{e: e, depth: depth, key: key, level: e.open, delegates: append(delegates, typ)}
+	pending := e.pending
+	e.pending = &b
+	err := EncodeWAF(enc, &b)
+	e.pending = pending
+	b.done = true
+	if err != nil {
+		b.release()
+		if err == types.ErrOutOfMemory {
+			return err
+		}
+		e.stats.Record(types.EncodeUnsupportedValue, 1)
+		return ErrUnsupportedValue
+	}
+	if b.ignored != nil {
+		// Already recorded in the stats
+		return b.ignored
+	}
+	if b.held == heldNothing {
+		e.stats.Record(types.EncodeUnsupportedValue, 1)
+		return ErrUnsupportedValue
+	}
+	return b.flush()
+}
+
+// heldValue is the kind of value held by the builder of a types.WAFEncodable
+// value.
+type heldValue int
+
+const (
+	heldNothing heldValue = iota
+	heldString
+	heldInt
+	heldUint
+	// The container is kept started in the sink
+	heldContainer
+)
+
+// builder builds a single value, which is either the value of a
+// types.WAFEncodable value, or an element of a container being built.
+type builder struct {
+	e     *Encoder
+	depth int
+	// Map key of the value, if any, and the container it is added to, if any,
+	// with its array index
+	key    string
+	parent *containerBuilder
+	index  int
+
+	// The error for which the value was ignored
+	ignored error
+	built   bool
+	// The encodable value is encoded
+	done bool
+
+	// The value of a types.WAFEncodable value, held until it is encoded, and
+	// the number of containers started in the sink when it started
+	held  heldValue
+	str   string
+	n     int64
+	u     uint64
+	level int
+	// Types of the types.WAFEncodable values delegating to this value,
+	// including its own
+	delegates []reflect.Type
+}
+
+// delegation is the types.WAFBuilder.Value call of a builder.
+type delegation struct {
+	// Types of the types.WAFEncodable values delegating to the value
+	types []reflect.Type
+	// Number of containers started in the sink when called, as the values
+	// within a container are not delegated to
+	level int
+}
+
+func (b *builder) String(s string) error {
+	return b.build(func() error {
+		return b.e.string(b.key, s)
+	})
+}
+
+func (b *builder) Int(n int64) error {
+	return b.build(func() error {
+		return b.e.int(b.key, n)
+	})
+}
+
+func (b *builder) Uint(n uint64) error {
+	return b.build(func() error {
+		return b.e.uint(b.key, n)
+	})
+}
+
+func (b *builder) Array(fn func(types.WAFArrayBuilder) error) error {
+	return b.build(func() error {
+		return b.e.buildContainer(b.key, false, fn, nil, b.depth+1)
+	})
+}
+
+func (b *builder) Map(fn func(types.WAFMapBuilder) error) error {
+	return b.build(func() error {
+		return b.e.buildContainer(b.key, true, nil, fn, b.depth+1)
+	})
+}
+
+func (b *builder) Value(v interface{}) error {
+	return b.build(func() error {
+		// Not accounted in the depth as it has no impact on the value
+		// representation
+		d := b.e.delegation
+		b.e.delegation = &delegation{types: b.delegates, level: b.e.open}
+		defer func() { b.e.delegation = d }()
+		return b.e.encodeValue(b.key, reflect.ValueOf(v), b.depth)
+	})
+}
+
+// build the value using the given function, which adds it to the parent
+// container, if any. Ignored values are not errors.
+func (b *builder) build(fn func() error) error {
+	if b.built || b.done || b.parent != nil && !b.parent.isCurrent() {
+		return types.ErrWAFBuilderUsed
+	}
+	b.built = true
+
+	if b.parent != nil {
+		if b.parent.length == b.parent.maxLength {
+			b.parent.dropped++
+			return nil
+		}
+		if b.parent.isMap {
+			b.e.stats.PushKey(b.key)
+		} else {
+			b.e.stats.PushIndex(b.index)
+		}
+		defer b.e.stats.Pop()
+	}
+
+	if err := fn(); err != nil {
+		if IsIgnoredValueError(err) {
+			b.ignored = err
+			return nil
+		}
+		return err
+	}
+	if b.parent != nil {
+		b.parent.length++
+	}
+	return nil
+}
+
+func (b *builder) holdString(s string) {
+	b.held, b.str = heldString, s
+}
+
+func (b *builder) holdInt(n int64) {
+	b.held, b.n = heldInt, n
+}
+
+func (b *builder) holdUint(n uint64) {
+	b.held, b.u = heldUint, n
+}
+
+func (b *builder) holdContainer() {
+	b.held = heldContainer
+}
+
+// flush adds the held value of the types.WAFEncodable value.
+func (b *builder) flush() error {
+	switch b.held {
+	case heldString:
+		return b.e.emitString(b.key, b.str)
+	case heldInt:
+		return b.e.emitInt(b.key, b.n)
+	case heldUint:
+		return b.e.emitUint(b.key, b.u)
+	default:
+		return b.e.endContainer(b.key)
+	}
+}
+
+// release the held value of the types.WAFEncodable value.
+func (b *builder) release() {
+	if b.held == heldContainer {
+		b.e.discard()
+	}
+	b.held = heldNothing
+}
+
+// containerBuilder builds an array or map value by adding the values of its
+// element builders.
+type containerBuilder struct {
+	e     *Encoder
+	isMap bool
+	depth int
+	// Nesting level of the container among the containers being built
+	level int
+	// Number of elements added, created and dropped
+	length, maxLength, count, dropped int
+}
+
+func (e *Encoder) buildContainer(key string, isMap bool, arrayFn func(types.WAFArrayBuilder) error, mapFn func(types.WAFMapBuilder) error, depth int) error {
+	if depth > e.MaxValueDepth {
+		e.stats.Record(types.EncodeDepthCutoff, 1)
+		return ErrMaxDepth
+	}
+
+	c := &containerBuilder{
+		e:         e,
+		isMap:     isMap,
+		depth:     depth,
+		maxLength: e.MaxArrayLength,
+	}
+	if isMap {
+		c.maxLength = e.MaxMapLength
+	}
+
+	// The elements can only be added to the innermost container being built
+	// so that the values are emitted in order.
+	e.start(isMap)
+	e.builderLevel++
+	c.level = e.builderLevel
+	ended := false
+	defer func() {
+		e.builderLevel--
+		c.level = 0
+		if !ended {
+			// Also when the function panicked
+			e.discard()
+		}
+	}()
+
+	var err error
+	if isMap {
+		err = mapFn(c)
+	} else {
+		err = arrayFn(c)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.dropped > 0 {
+		issue := types.EncodeDroppedArrayEntries
+		if isMap {
+			issue = types.EncodeDroppedMapEntries
+		}
+		e.stats.Record(issue, c.dropped)
+	}
+	ended = true
+	return e.end(key)
+}
+
+func (c *containerBuilder) Append() types.WAFBuilder {
+	b := &builder{e: c.e, depth: c.depth, parent: c, index: c.count}
+	c.count++
+	return b
+}
+
+func (c *containerBuilder) Entry(key string) types.WAFBuilder {
+	return &builder{e: c.e, depth: c.depth, parent: c, key: key}
+}
+
+// isCurrent returns true when the container is the innermost container being
+// built.
+func (c *containerBuilder) isCurrent() bool {
+	return c.level != 0 && c.level == c.e.builderLevel
+}
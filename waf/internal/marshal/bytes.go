@@ -0,0 +1,75 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	readerType     = reflect.TypeOf((*io.Reader)(nil)).Elem()
+)
+
+// Bytes returns the content of byte slices and io.Reader values up to
+// maxLength bytes. truncated is true when the content is longer, or possibly
+// longer in the case of readers as they are read up to maxLength bytes only.
+// ok is false when the value is neither a byte slice nor a reader.
+func Bytes(v reflect.Value, maxLength int) (b []byte, truncated bool, ok bool, err error) {
+	if !v.IsValid() {
+		return nil, false, false, nil
+	}
+
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+		b = v.Bytes()
+		if len(b) > maxLength {
+			return b[:maxLength], true, true, nil
+		}
+		return b, false, true, nil
+	}
+
+	if v.Kind() == reflect.Ptr && v.IsNil() || !v.CanInterface() || !v.Type().Implements(readerType) {
+		return nil, false, false, nil
+	}
+	b, err = ioutil.ReadAll(io.LimitReader(v.Interface().(io.Reader), int64(maxLength)))
+	if err != nil && len(b) == 0 {
+		return nil, false, true, err
+	}
+	return b, len(b) == maxLength, true, nil
+}
+
+// BytesString returns the string of the bytes according to the bytes
+// encoding.
+func BytesString(b []byte, encoding types.BytesEncoding) string {
+	if encoding == types.BytesRaw || utf8.Valid(b) && bytes.IndexByte(b, '\\') < 0 {
+		return string(b)
+	}
+
+	const hex = "0123456789abcdef"
+	var str strings.Builder
+	str.Grow(len(b))
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size == 1 {
+			str.WriteString(`\x`)
+			str.WriteByte(hex[b[0]>>4])
+			str.WriteByte(hex[b[0]&0xf])
+		} else if r == '\\' {
+			str.WriteString(`\\`)
+		} else {
+			str.Write(b[:size])
+		}
+		b = b[size:]
+	}
+	return str.String()
+}
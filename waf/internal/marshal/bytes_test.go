@@ -0,0 +1,92 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/marshal"
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+type testErrReader struct{}
+
+func (testErrReader) Read([]byte) (int, error) { return 0, errors.New("oops") }
+
+func TestBytes(t *testing.T) {
+	for _, tc := range []struct {
+		Name              string
+		Data              interface{}
+		ExpectedBytes     string
+		ExpectedTruncated bool
+		ExpectedNotOK     bool
+		ExpectedError     bool
+	}{
+		{Name: "byte slice", Data: []byte("body"), ExpectedBytes: "body"},
+		{Name: "truncated byte slice", Data: []byte("long body"), ExpectedBytes: "long", ExpectedTruncated: true},
+		{Name: "nil byte slice", Data: []byte(nil), ExpectedBytes: ""},
+		{Name: "json raw message", Data: json.RawMessage(`"a"`), ExpectedBytes: `"a"`},
+		{Name: "reader", Data: strings.NewReader("bod"), ExpectedBytes: "bod"},
+		{Name: "possibly truncated reader", Data: strings.NewReader("long body"), ExpectedBytes: "long", ExpectedTruncated: true},
+		{Name: "one byte reader", Data: iotest.OneByteReader(strings.NewReader("bod")), ExpectedBytes: "bod"},
+		{Name: "failing reader", Data: iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader("body"))), ExpectedBytes: "b"},
+		{Name: "failed reader", Data: testErrReader{}, ExpectedError: true},
+		{Name: "nil reader", Data: (*strings.Reader)(nil), ExpectedNotOK: true},
+		{Name: "int slice", Data: []int{1}, ExpectedNotOK: true},
+		{Name: "string", Data: "body", ExpectedNotOK: true},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			b, truncated, ok, err := marshal.Bytes(reflect.ValueOf(tc.Data), 4)
+			if tc.ExpectedNotOK {
+				require.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			if tc.ExpectedError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.ExpectedBytes, string(b))
+			require.Equal(t, tc.ExpectedTruncated, truncated)
+		})
+	}
+
+	t.Run("reader consumption", func(t *testing.T) {
+		r := bytes.NewReader([]byte("long body"))
+		_, _, _, err := marshal.Bytes(reflect.ValueOf(r), 4)
+		require.NoError(t, err)
+		rest, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, " body", string(rest))
+	})
+}
+
+func TestBytesString(t *testing.T) {
+	for _, tc := range []struct {
+		Data           string
+		Encoding       types.BytesEncoding
+		ExpectedString string
+	}{
+		{Data: "héllo", Encoding: types.BytesRaw, ExpectedString: "héllo"},
+		{Data: "héllo", Encoding: types.BytesEscaped, ExpectedString: "héllo"},
+		{Data: "a\xffé\xc3", Encoding: types.BytesRaw, ExpectedString: "a\xffé\xc3"},
+		{Data: "a\xffé\xc3", Encoding: types.BytesEscaped, ExpectedString: `a\xffé\xc3`},
+		{Data: `C:\dir`, Encoding: types.BytesRaw, ExpectedString: `C:\dir`},
+		{Data: `C:\dir`, Encoding: types.BytesEscaped, ExpectedString: `C:\\dir`},
+		{Data: `\xff` + "\xff", Encoding: types.BytesEscaped, ExpectedString: `\\xff\xff`},
+	} {
+		require.Equal(t, tc.ExpectedString, marshal.BytesString([]byte(tc.Data), tc.Encoding))
+	}
+}
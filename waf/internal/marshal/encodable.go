@@ -0,0 +1,75 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+var wafEncodableType = reflect.TypeOf((*types.WAFEncodable)(nil)).Elem()
+
+// WAFEncodable implementations of the types.
+var encodableImplementations sync.Map // map[reflect.Type]implementation
+
+func encodableImplementation(t reflect.Type) implementation {
+	if impl, ok := encodableImplementations.Load(t); ok {
+		return impl.(implementation)
+	}
+	impl := notImplemented
+	if t.Implements(wafEncodableType) {
+		impl = valueImplementation
+	} else if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(wafEncodableType) {
+		impl = pointerImplementation
+	}
+	encodableImplementations.Store(t, impl)
+	return impl
+}
+
+// Encodable returns the types.WAFEncodable implementation of the value,
+// including through a pointer receiver. ok is false when the value does not
+// implement it, is a nil pointer, or is an interface value which is rather
+// expected to be passed once unwrapped.
+func Encodable(v reflect.Value) (enc types.WAFEncodable, ok bool) {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		return nil, false
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil, false
+		}
+	}
+
+	switch encodableImplementation(v.Type()) {
+	case notImplemented:
+		return nil, false
+	case pointerImplementation:
+		if v.CanAddr() {
+			v = v.Addr()
+		} else {
+			p := reflect.New(v.Type())
+			p.Elem().Set(v)
+			v = p
+		}
+	}
+	return v.Interface().(types.WAFEncodable), true
+}
+
+// EncodeWAF calls the EncodeWAF method of the value and returns its error, or
+// an error when it panicked.
+func EncodeWAF(enc types.WAFEncodable, b types.WAFBuilder) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("waf encodable panic: %v", r)
+		}
+	}()
+	return enc.EncodeWAF(b)
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/marshal"
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+type testEncodable string
+
+func (e testEncodable) EncodeWAF(b types.WAFBuilder) error {
+	if e == "panic" {
+		panic("oops")
+	}
+	return b.String(string(e))
+}
+
+type testPointerEncodable struct{ s string }
+
+func (e *testPointerEncodable) EncodeWAF(b types.WAFBuilder) error {
+	return b.String(e.s)
+}
+
+// testStringBuilder is a types.WAFBuilder only building strings.
+type testStringBuilder struct {
+	types.WAFBuilder
+	s string
+}
+
+func (b *testStringBuilder) String(s string) error {
+	b.s = s
+	return nil
+}
+
+func TestEncodable(t *testing.T) {
+	var iface interface{} = testEncodable("iface")
+	for _, tc := range []struct {
+		Name           string
+		Data           reflect.Value
+		ExpectedString string
+		ExpectedNotOK  bool
+	}{
+		{Name: "value receiver", Data: reflect.ValueOf(testEncodable("value")), ExpectedString: "value"},
+		{Name: "pointer to value receiver", Data: reflect.ValueOf(func() *testEncodable { e := testEncodable("ptr"); return &e }()), ExpectedString: "ptr"},
+		{Name: "pointer receiver", Data: reflect.ValueOf(&testPointerEncodable{s: "ptr"}), ExpectedString: "ptr"},
+		{Name: "unaddressable pointer receiver", Data: reflect.ValueOf(testPointerEncodable{s: "copy"}), ExpectedString: "copy"},
+		{Name: "addressable pointer receiver", Data: reflect.ValueOf(&[]testPointerEncodable{{s: "elem"}}).Elem().Index(0), ExpectedString: "elem"},
+		{Name: "nil pointer", Data: reflect.ValueOf((*testPointerEncodable)(nil)), ExpectedNotOK: true},
+		{Name: "interface", Data: reflect.ValueOf(&iface).Elem(), ExpectedNotOK: true},
+		{Name: "not implemented", Data: reflect.ValueOf("string"), ExpectedNotOK: true},
+		{Name: "invalid", Data: reflect.Value{}, ExpectedNotOK: true},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			enc, ok := marshal.Encodable(tc.Data)
+			if tc.ExpectedNotOK {
+				require.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			var b testStringBuilder
+			require.NoError(t, marshal.EncodeWAF(enc, &b))
+			require.Equal(t, tc.ExpectedString, b.s)
+		})
+	}
+
+	t.Run("panic", func(t *testing.T) {
+		require.Error(t, marshal.EncodeWAF(testEncodable("panic"), &testStringBuilder{}))
+	})
+}
@@ -0,0 +1,492 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// Package marshal implements the encoding of Go values shared by the WAF
+// engines.
+package marshal
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// Errors of the values which are not encoded. They are recorded in the
+// encoding statistics and the values are ignored when they are container
+// elements.
+var (
+	ErrMaxDepth         = errors.New("max depth reached")
+	ErrUnsupportedValue = errors.New("unsupported value")
+	ErrCycle            = errors.New("cycle detected")
+	ErrRepeatedRef      = errors.New("too many repeated references")
+)
+
+// IsIgnoredValueError returns true when the error is the error of a value
+// which is not encoded.
+func IsIgnoredValueError(err error) bool {
+	return err == ErrUnsupportedValue || err == ErrMaxDepth || err == ErrCycle ||
+		err == ErrRepeatedRef
+}
+
+// Sink builds the WAF values of an engine out of the values emitted by the
+// Encoder. The values are emitted depth-first: they are added to the innermost
+// container started, along with their key when it is a map, or are the
+// encoded value when no container is started. Strings and keys are already
+// truncated to the maximum string length.
+type Sink interface {
+	String(key, s string) error
+	Int(key string, n int64) error
+	Uint(key string, n uint64) error
+	// Start a new array or map container, which becomes the innermost one.
+	Start(isMap bool)
+	// End the innermost container and add it. The container is removed even
+	// when it cannot be added.
+	End(key string) error
+	// Discard the innermost container and the entries added so far.
+	Discard()
+}
+
+// Encoder encodes Go values into the WAF values of a Sink, according to its
+// limits and the encoding rules shared by the WAF engines: values deeper than
+// the maximum depth, unsupported values and cycles are ignored, strings and
+// containers are truncated, and every value which is not fully encoded is
+// recorded in the encoding statistics.
+type Encoder struct {
+	MaxValueDepth   int
+	MaxStringLength int
+	MaxArrayLength  int
+	MaxMapLength    int
+	// Map keys and struct fields kept first when truncating maps and structs
+	PriorityKeys []string
+	// Only encode the map entries having string keys
+	StrictMapKeys bool
+	// Marshaler interfaces used to encode values as strings, by order of
+	// priority
+	Marshalers []types.Marshaler
+	// Use the json tag of struct fields having no waf tag
+	JSONTagFallback bool
+	// Encoding of floating-point numbers
+	FloatEncoding types.FloatEncoding
+	// Encoding of byte contents
+	BytesEncoding types.BytesEncoding
+	// Disable the reflection-free fast path
+	ReflectOnly bool
+
+	sink Sink
+	// Number of WAF values encoded so far
+	nbValues int
+	// Statistics of the values not fully encoded
+	stats Stats
+	// References on the path of the value being encoded
+	refs Refs
+	// Number of references encoded again
+	repeatedRefs int
+	// Number of containers started in the sink
+	open int
+	// Number of containers being built by types.WAFEncodable values
+	builderLevel int
+	// Builder of the types.WAFEncodable value being encoded, whose value is
+	// held until it is successfully encoded
+	pending *builder
+	// types.WAFEncodable values delegating their value to the value being
+	// encoded through types.WAFBuilder.Value
+	delegation *delegation
+}
+
+// NewEncoder returns the encoder having the limits of the given configuration,
+// which is expected to be valid and have its default values set.
+func NewEncoder(config types.Config) Encoder {
+	return Encoder{
+		MaxValueDepth:   config.MaxValueDepth,
+		MaxStringLength: config.MaxStringLength,
+		MaxArrayLength:  config.MaxArrayLength,
+		MaxMapLength:    config.MaxMapLength,
+		PriorityKeys:    config.PriorityKeys,
+		StrictMapKeys:   config.StrictMapKeys,
+		Marshalers:      config.Marshalers,
+		JSONTagFallback: config.JSONTagFallback,
+		FloatEncoding:   config.FloatEncoding,
+		BytesEncoding:   config.BytesEncoding,
+	}
+}
+
+// Encode the data into the sink using a copy of the encoder, so that the
+// encoding accounting is specific to this call and concurrent calls are safe.
+// The returned error is either one of the errors of the ignored values when
+// the data itself is not encoded, or the sink error which aborted the
+// encoding.
+func (e Encoder) Encode(data interface{}, sink Sink) (nbValues int, stats types.EncodeStats, err error) {
+	e.sink = sink
+	e.nbValues = 0
+	e.stats = Stats{}
+	e.refs = Refs{}
+	e.repeatedRefs = 0
+	e.open = 0
+	e.builderLevel = 0
+	e.pending = nil
+	e.delegation = nil
+	if e.ReflectOnly {
+		err = e.encodeValue("", reflect.ValueOf(data), 0)
+	} else {
+		err = e.encodeInterface("", data, 0)
+	}
+	return e.nbValues, e.stats.EncodeStats, err
+}
+
+func (e *Encoder) encodeValue(key string, data reflect.Value, depth int) error {
+	if depth > e.MaxValueDepth {
+		// Stop traversing
+		e.stats.Record(types.EncodeDepthCutoff, 1)
+		return ErrMaxDepth
+	}
+
+	// Interface and map values can be passed to the fast path without
+	// allocating a copy.
+	if kind := data.Kind(); (kind == reflect.Interface || kind == reflect.Map) && !e.ReflectOnly && data.CanInterface() {
+		if ok, err := e.encodeFast(key, data.Interface(), depth); ok {
+			return err
+		}
+	}
+
+	if enc, ok := Encodable(data); ok {
+		return e.encodeEncodable(key, enc, depth)
+	}
+
+	if str, ok := BigNumber(data); ok {
+		return e.string(key, str)
+	}
+
+	if str, ok, err := String(data, e.Marshalers); ok {
+		if err != nil {
+			e.stats.Record(types.EncodeUnsupportedValue, 1)
+			return ErrUnsupportedValue
+		}
+		return e.string(key, str)
+	}
+
+	if b, truncated, ok, err := Bytes(data, e.MaxStringLength); ok {
+		if err != nil {
+			e.stats.Record(types.EncodeUnsupportedValue, 1)
+			return ErrUnsupportedValue
+		}
+		str := BytesString(b, e.BytesEncoding)
+		if truncated && len(str) <= e.MaxStringLength {
+			e.stats.Record(types.EncodeTruncatedString, 1)
+		}
+		return e.string(key, str)
+	}
+
+	switch kind := data.Kind(); kind {
+	default:
+		e.stats.Record(types.EncodeUnsupportedValue, 1)
+		return ErrUnsupportedValue
+
+	case reflect.Bool:
+		var b uint64
+		if data.Bool() {
+			b = 1
+		}
+		return e.uint(key, b)
+
+	case reflect.Struct:
+		return e.encodeStruct(key, data, depth+1)
+
+	case reflect.Ptr:
+		return e.encodePointer(key, data, depth)
+
+	case reflect.Interface:
+		// Not accounted in the depth as it has no impact on the value
+		// representation
+		return e.encodeValue(key, data.Elem(), depth)
+
+	case reflect.String:
+		return e.string(key, data.String())
+
+	case reflect.Map:
+		return e.encodeMap(key, data, depth+1)
+
+	case reflect.Array, reflect.Slice:
+		return e.encodeArray(key, data, depth+1)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.int(key, data.Int())
+
+	case reflect.Float32, reflect.Float64:
+		str, n, isString := Float(data, e.FloatEncoding)
+		if isString {
+			return e.string(key, str)
+		}
+		return e.int(key, n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return e.uint(key, data.Uint())
+	}
+}
+
+// encodePointer encodes the value pointed to, unless it is a cycle.
+func (e *Encoder) encodePointer(key string, data reflect.Value, depth int) error {
+	if err := e.enterRef(data); err != nil {
+		return err
+	}
+	// Not accounted in the depth as it has no impact on the value
+	// representation
+	err := e.encodeValue(key, data.Elem(), depth)
+	e.refs.Leave(data)
+	return err
+}
+
+// enterRef adds the reference value to the current path, and records it as a
+// cycle when it is already in it. A reference already encoded elsewhere is
+// only encoded again up to types.MaxRepeatedRefs times per data set.
+func (e *Encoder) enterRef(data reflect.Value) error {
+	if !e.refs.Enter(data) {
+		e.stats.Record(types.EncodeCycle, 1)
+		return ErrCycle
+	}
+	if e.refs.Repeated(data) {
+		if e.repeatedRefs >= types.MaxRepeatedRefs {
+			e.refs.Leave(data)
+			e.stats.Record(types.EncodeRepeatedRef, 1)
+			return ErrRepeatedRef
+		}
+		e.repeatedRefs++
+	}
+	return nil
+}
+
+func (e *Encoder) encodeStruct(key string, data reflect.Value, depth int) error {
+	if depth > e.MaxValueDepth {
+		e.stats.Record(types.EncodeDepthCutoff, 1)
+		return ErrMaxDepth
+	}
+
+	e.start(true)
+	ended := false
+	defer func() {
+		if !ended {
+			e.discard()
+		}
+	}()
+
+	fields := StructFields(data.Type(), e.JSONTagFallback)
+	if len(fields) > e.MaxMapLength {
+		fields = PriorityFields(fields, e.PriorityKeys)
+	}
+	i := 0
+	for length := 0; length < e.MaxMapLength && i < len(fields); i++ {
+		field := &fields[i]
+		fv, ok := field.Value(data)
+		if !ok || field.OmitEmpty && IsEmpty(fv) {
+			continue
+		}
+
+		e.stats.PushKey(field.Name)
+		err := e.encodeValue(field.Name, fv, depth)
+		e.stats.Pop()
+		if err != nil {
+			if IsIgnoredValueError(err) {
+				continue
+			}
+			return err
+		}
+
+		length++
+	}
+	if dropped := len(fields) - i; dropped > 0 {
+		e.stats.Record(types.EncodeDroppedMapEntries, dropped)
+	}
+
+	ended = true
+	return e.end(key)
+}
+
+func (e *Encoder) encodeMap(key string, data reflect.Value, depth int) error {
+	if depth > e.MaxValueDepth {
+		e.stats.Record(types.EncodeDepthCutoff, 1)
+		return ErrMaxDepth
+	}
+	if err := e.enterRef(data); err != nil {
+		return err
+	}
+	defer e.refs.Leave(data)
+
+	e.start(true)
+	ended := false
+	defer func() {
+		if !ended {
+			e.discard()
+		}
+	}()
+
+	// Marshal map entries
+	iterated := 0
+	iter := NewMapIter(data, e.MaxMapLength, e.PriorityKeys, KeyOptions{
+		Strict:     e.StrictMapKeys,
+		Marshalers: e.Marshalers,
+	})
+	for length := 0; length < e.MaxMapLength && iter.Next(); iterated++ {
+		k, ok := iter.StringKey()
+		if !ok {
+			e.stats.Record(types.EncodeUnsupportedValue, 1)
+			continue
+		}
+		e.stats.PushKey(k)
+		err := e.encodeValue(k, iter.Value(), depth)
+		e.stats.Pop()
+		if err != nil {
+			if IsIgnoredValueError(err) {
+				continue
+			}
+			return err
+		}
+
+		length++
+	}
+	if dropped := data.Len() - iterated; dropped > 0 {
+		e.stats.Record(types.EncodeDroppedMapEntries, dropped)
+	}
+
+	ended = true
+	return e.end(key)
+}
+
+func (e *Encoder) encodeArray(key string, data reflect.Value, depth int) error {
+	if depth > e.MaxValueDepth {
+		e.stats.Record(types.EncodeDepthCutoff, 1)
+		return ErrMaxDepth
+	}
+	if err := e.enterRef(data); err != nil {
+		return err
+	}
+	defer e.refs.Leave(data)
+
+	e.start(false)
+	ended := false
+	defer func() {
+		if !ended {
+			e.discard()
+		}
+	}()
+
+	// Profiling shows `data.Len()` is called every loop if it is
+	// used in the loop condition.
+	l := data.Len()
+	i := 0
+	for length := 0; length < e.MaxArrayLength && i < l; i++ {
+		e.stats.PushIndex(i)
+		err := e.encodeValue("", data.Index(i), depth)
+		e.stats.Pop()
+		if err != nil {
+			if IsIgnoredValueError(err) {
+				continue
+			}
+			return err
+		}
+
+		length++
+	}
+	if dropped := l - i; dropped > 0 {
+		e.stats.Record(types.EncodeDroppedArrayEntries, dropped)
+	}
+
+	ended = true
+	return e.end(key)
+}
+
+// string emits the string truncated to the maximum string length.
+func (e *Encoder) string(key, str string) error {
+	if len(str) > e.MaxStringLength {
+		str = str[:e.MaxStringLength]
+		e.stats.Record(types.EncodeTruncatedString, 1)
+	}
+	e.nbValues++
+	return e.emitString(key, str)
+}
+
+func (e *Encoder) int(key string, n int64) error {
+	e.nbValues++
+	return e.emitInt(key, n)
+}
+
+func (e *Encoder) uint(key string, n uint64) error {
+	e.nbValues++
+	return e.emitUint(key, n)
+}
+
+// emitString adds the string to the sink, unless it is the value of the
+// types.WAFEncodable value being encoded, which holds it until it is encoded.
+func (e *Encoder) emitString(key, str string) error {
+	if b := e.pendingBuilder(); b != nil {
+		b.holdString(str)
+		return nil
+	}
+	return e.sink.String(e.key(key), str)
+}
+
+func (e *Encoder) emitInt(key string, n int64) error {
+	if b := e.pendingBuilder(); b != nil {
+		b.holdInt(n)
+		return nil
+	}
+	return e.sink.Int(e.key(key), n)
+}
+
+func (e *Encoder) emitUint(key string, n uint64) error {
+	if b := e.pendingBuilder(); b != nil {
+		b.holdUint(n)
+		return nil
+	}
+	return e.sink.Uint(e.key(key), n)
+}
+
+// key returns the map key truncated to the maximum string length. The key is
+// expected to be the last element of the current key path.
+func (e *Encoder) key(key string) string {
+	if len(key) > e.MaxStringLength {
+		e.stats.Record(types.EncodeTruncatedString, 1)
+		return key[:e.MaxStringLength]
+	}
+	return key
+}
+
+// start a new container in the sink. It must be either ended or discarded.
+func (e *Encoder) start(isMap bool) {
+	e.open++
+	e.sink.Start(isMap)
+}
+
+// end the container once all its entries were added.
+func (e *Encoder) end(key string) error {
+	e.nbValues++
+	return e.endContainer(key)
+}
+
+// endContainer ends the container in the sink, unless it is the value of the
+// types.WAFEncodable value being encoded, which keeps it started until it is
+// encoded.
+func (e *Encoder) endContainer(key string) error {
+	if b := e.pending; b != nil && b.level == e.open-1 {
+		b.holdContainer()
+		return nil
+	}
+	e.open--
+	return e.sink.End(e.key(key))
+}
+
+// discard the container along with its entries.
+func (e *Encoder) discard() {
+	e.open--
+	e.sink.Discard()
+}
+
+// pendingBuilder returns the builder of the types.WAFEncodable value being
+// encoded when the value to emit is its value.
+func (e *Encoder) pendingBuilder() *builder {
+	if b := e.pending; b != nil && b.level == e.open {
+		return b
+	}
+	return nil
+}
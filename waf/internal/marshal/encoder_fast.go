@@ -0,0 +1,253 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// encodeFast encodes the common concrete types of HTTP requests and JSON
+// documents without reflection. The result is the same as the reflective
+// encoding. ok is false when the type of data is not one of them. The value
+// depth is expected to be already checked.
+func (e *Encoder) encodeFast(key string, data interface{}, depth int) (ok bool, err error) {
+	switch data := data.(type) {
+	default:
+		return false, nil
+
+	case string:
+		err = e.string(key, data)
+	case bool:
+		var b uint64
+		if data {
+			b = 1
+		}
+		err = e.uint(key, b)
+	case float64:
+		err = e.encodeFloat(key, data)
+	case int:
+		err = e.int(key, int64(data))
+
+	case []string:
+		err = e.encodeStringArray(key, data, depth+1)
+	case []interface{}:
+		err = e.encodeInterfaceArray(key, data, depth+1)
+	case map[string]string:
+		err = e.encodeStringMap(key, data, depth+1)
+	case map[string][]string:
+		err = e.encodeStringArrayMap(key, data, depth+1)
+	case http.Header:
+		err = e.encodeStringArrayMap(key, data, depth+1)
+	case url.Values:
+		err = e.encodeStringArrayMap(key, data, depth+1)
+	case map[string]interface{}:
+		err = e.encodeInterfaceMap(key, data, depth+1)
+	case types.DataSet:
+		err = e.encodeInterfaceMap(key, data, depth+1)
+	}
+	return true, err
+}
+
+// encodeInterface encodes the value using the fast path when possible, and
+// using reflection otherwise.
+func (e *Encoder) encodeInterface(key string, data interface{}, depth int) error {
+	if depth > e.MaxValueDepth {
+		e.stats.Record(types.EncodeDepthCutoff, 1)
+		return ErrMaxDepth
+	}
+	if ok, err := e.encodeFast(key, data, depth); ok {
+		return err
+	}
+	return e.encodeValue(key, reflect.ValueOf(data), depth)
+}
+
+func (e *Encoder) encodeFloat(key string, f float64) error {
+	str, n, isString := FloatValue(f, 64, e.FloatEncoding)
+	if isString {
+		return e.string(key, str)
+	}
+	return e.int(key, n)
+}
+
+func (e *Encoder) encodeStringArray(key string, data []string, depth int) error {
+	if depth > e.MaxValueDepth {
+		e.stats.Record(types.EncodeDepthCutoff, 1)
+		return ErrMaxDepth
+	}
+
+	e.start(false)
+	ended := false
+	defer func() {
+		if !ended {
+			e.discard()
+		}
+	}()
+
+	l := len(data)
+	if l > e.MaxArrayLength {
+		l = e.MaxArrayLength
+		e.stats.Record(types.EncodeDroppedArrayEntries, len(data)-l)
+	}
+	for i, str := range data[:l] {
+		e.stats.PushIndex(i)
+		err := e.string("", str)
+		e.stats.Pop()
+		if err != nil {
+			return err
+		}
+	}
+
+	ended = true
+	return e.end(key)
+}
+
+func (e *Encoder) encodeInterfaceArray(key string, data []interface{}, depth int) error {
+	if depth > e.MaxValueDepth {
+		e.stats.Record(types.EncodeDepthCutoff, 1)
+		return ErrMaxDepth
+	}
+	ref := reflect.ValueOf(data)
+	if err := e.enterRef(ref); err != nil {
+		return err
+	}
+	defer e.refs.Leave(ref)
+
+	e.start(false)
+	ended := false
+	defer func() {
+		if !ended {
+			e.discard()
+		}
+	}()
+
+	l := len(data)
+	i := 0
+	for length := 0; length < e.MaxArrayLength && i < l; i++ {
+		e.stats.PushIndex(i)
+		err := e.encodeInterface("", data[i], depth)
+		e.stats.Pop()
+		if err != nil {
+			if IsIgnoredValueError(err) {
+				continue
+			}
+			return err
+		}
+		length++
+	}
+	if dropped := l - i; dropped > 0 {
+		e.stats.Record(types.EncodeDroppedArrayEntries, dropped)
+	}
+
+	ended = true
+	return e.end(key)
+}
+
+func (e *Encoder) encodeStringMap(key string, data map[string]string, depth int) error {
+	if len(data) > e.MaxMapLength {
+		// Truncated maps are encoded in the deterministic key order
+		return e.encodeMap(key, reflect.ValueOf(data), depth)
+	}
+	if depth > e.MaxValueDepth {
+		e.stats.Record(types.EncodeDepthCutoff, 1)
+		return ErrMaxDepth
+	}
+
+	e.start(true)
+	ended := false
+	defer func() {
+		if !ended {
+			e.discard()
+		}
+	}()
+
+	for k, str := range data {
+		e.stats.PushKey(k)
+		err := e.string(k, str)
+		e.stats.Pop()
+		if err != nil {
+			return err
+		}
+	}
+
+	ended = true
+	return e.end(key)
+}
+
+func (e *Encoder) encodeStringArrayMap(key string, data map[string][]string, depth int) error {
+	if len(data) > e.MaxMapLength {
+		// Truncated maps are encoded in the deterministic key order
+		return e.encodeMap(key, reflect.ValueOf(data), depth)
+	}
+	if depth > e.MaxValueDepth {
+		e.stats.Record(types.EncodeDepthCutoff, 1)
+		return ErrMaxDepth
+	}
+
+	e.start(true)
+	ended := false
+	defer func() {
+		if !ended {
+			e.discard()
+		}
+	}()
+
+	for k, values := range data {
+		e.stats.PushKey(k)
+		err := e.encodeStringArray(k, values, depth+1)
+		e.stats.Pop()
+		if err != nil {
+			if IsIgnoredValueError(err) {
+				continue
+			}
+			return err
+		}
+	}
+
+	ended = true
+	return e.end(key)
+}
+
+func (e *Encoder) encodeInterfaceMap(key string, data map[string]interface{}, depth int) error {
+	if len(data) > e.MaxMapLength {
+		// Truncated maps are encoded in the deterministic key order
+		return e.encodeMap(key, reflect.ValueOf(data), depth)
+	}
+	if depth > e.MaxValueDepth {
+		e.stats.Record(types.EncodeDepthCutoff, 1)
+		return ErrMaxDepth
+	}
+	ref := reflect.ValueOf(data)
+	if err := e.enterRef(ref); err != nil {
+		return err
+	}
+	defer e.refs.Leave(ref)
+
+	e.start(true)
+	ended := false
+	defer func() {
+		if !ended {
+			e.discard()
+		}
+	}()
+
+	for k, value := range data {
+		e.stats.PushKey(k)
+		err := e.encodeInterface(k, value, depth)
+		e.stats.Pop()
+		if err != nil {
+			if IsIgnoredValueError(err) {
+				continue
+			}
+			return err
+		}
+	}
+
+	ended = true
+	return e.end(key)
+}
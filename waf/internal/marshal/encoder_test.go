@@ -0,0 +1,305 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/marshal"
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+// testSink builds the Go values of the encoded values: strings, int64,
+// uint64, []interface{} and map[string]interface{}.
+type testSink struct {
+	containers []interface{}
+	v          interface{}
+	// String value failing when emitted
+	fail string
+}
+
+var errTestSink = errors.New("sink error")
+
+func (s *testSink) String(key, str string) error {
+	if s.fail != "" && str == s.fail {
+		return errTestSink
+	}
+	s.add(key, str)
+	return nil
+}
+
+func (s *testSink) Int(key string, n int64) error {
+	s.add(key, n)
+	return nil
+}
+
+func (s *testSink) Uint(key string, n uint64) error {
+	s.add(key, n)
+	return nil
+}
+
+func (s *testSink) Start(isMap bool) {
+	if isMap {
+		s.containers = append(s.containers, map[string]interface{}{})
+	} else {
+		s.containers = append(s.containers, []interface{}{})
+	}
+}
+
+func (s *testSink) End(key string) error {
+	s.add(key, s.pop())
+	return nil
+}
+
+func (s *testSink) Discard() {
+	s.pop()
+}
+
+func (s *testSink) pop() interface{} {
+	last := len(s.containers) - 1
+	v := s.containers[last]
+	s.containers = s.containers[:last]
+	return v
+}
+
+func (s *testSink) add(key string, v interface{}) {
+	if len(s.containers) == 0 {
+		s.v = v
+		return
+	}
+	last := len(s.containers) - 1
+	switch c := s.containers[last].(type) {
+	case map[string]interface{}:
+		c[key] = v
+	case []interface{}:
+		s.containers[last] = append(c, v)
+	}
+}
+
+func testEncoder() marshal.Encoder {
+	return marshal.NewEncoder(types.Config{
+		MaxValueDepth:   4,
+		MaxStringLength: 8,
+		MaxArrayLength:  3,
+		MaxMapLength:    3,
+		Marshalers:      types.DefaultMarshalers(),
+	})
+}
+
+// testFailingEncodable builds a map value before returning an error.
+type testFailingEncodable struct{}
+
+func (testFailingEncodable) EncodeWAF(b types.WAFBuilder) error {
+	err := b.Map(func(m types.WAFMapBuilder) error {
+		return m.Entry("k").String("v")
+	})
+	if err != nil {
+		return err
+	}
+	return errors.New("oops")
+}
+
+// testRecursiveEncodable delegates its value to itself.
+type testRecursiveEncodable struct{}
+
+func (e testRecursiveEncodable) EncodeWAF(b types.WAFBuilder) error {
+	return b.Value(e)
+}
+
+// testValueEncodable delegates its value to the Go value.
+type testValueEncodable struct{ v interface{} }
+
+func (e testValueEncodable) EncodeWAF(b types.WAFBuilder) error {
+	return b.Value(e.v)
+}
+
+// testNode is a node of a DAG whose children can be shared.
+type testNode struct {
+	Left, Right *testNode
+}
+
+func TestEncoder(t *testing.T) {
+	t.Run("fast path", func(t *testing.T) {
+		var jsonBody interface{}
+		err := json.Unmarshal([]byte(`{"a": [1, 2.5, "three", {"b": true}], "c": {}, "d": [[[["deep"]]]]}`), &jsonBody)
+		require.NoError(t, err)
+
+		for name, data := range map[string]interface{}{
+			"json":    jsonBody,
+			"header":  http.Header{"K": {"v1", "too long value"}, "Empty": nil},
+			"values":  url.Values{"k": {"1", "2", "3", "4"}},
+			"strings": map[string]string{"k1": "v", "k2": "too long value"},
+			"data set": types.DataSet{
+				"k": []string{"a", "b"},
+				"f": func() {},
+			},
+		} {
+			data := data
+			t.Run(name, func(t *testing.T) {
+				fast := testEncoder()
+				var fastSink testSink
+				fastN, fastStats, fastErr := fast.Encode(data, &fastSink)
+
+				reflective := testEncoder()
+				reflective.ReflectOnly = true
+				var reflectSink testSink
+				reflectN, reflectStats, reflectErr := reflective.Encode(data, &reflectSink)
+
+				require.NoError(t, fastErr)
+				require.NoError(t, reflectErr)
+				require.Equal(t, reflectSink.v, fastSink.v)
+				require.Equal(t, reflectN, fastN)
+				require.ElementsMatch(t, reflectStats.Events, fastStats.Events)
+				require.Empty(t, fastSink.containers)
+				require.Empty(t, reflectSink.containers)
+			})
+		}
+	})
+
+	t.Run("ignored values", func(t *testing.T) {
+		var s testSink
+		n, stats, err := testEncoder().Encode(types.DataSet{
+			"f":            func() {},
+			"deep":         []interface{}{[]interface{}{[]interface{}{[]interface{}{"v"}}}},
+			"too long key": "too long value",
+		}, &s)
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{
+			"deep":     []interface{}{[]interface{}{[]interface{}{}}},
+			"too long": "too long",
+		}, s.v)
+		// The map, the three arrays and the string
+		require.Equal(t, 5, n)
+		require.Equal(t, 1, stats.UnsupportedValues)
+		require.Equal(t, 1, stats.DepthCutoffs)
+		require.Equal(t, 2, stats.TruncatedStrings)
+		require.ElementsMatch(t, []types.EncodeEvent{
+			{Issue: types.EncodeUnsupportedValue, KeyPath: []string{"f"}},
+			{Issue: types.EncodeDepthCutoff, KeyPath: []string{"deep", "0", "0", "0"}},
+			{Issue: types.EncodeTruncatedString, KeyPath: []string{"too long key"}},
+			{Issue: types.EncodeTruncatedString, KeyPath: []string{"too long key"}},
+		}, stats.Events)
+		require.Empty(t, s.containers)
+	})
+
+	t.Run("shared references", func(t *testing.T) {
+		// Every level references the next one twice, so that the last level is
+		// reachable through 2^30 paths
+		node := &testNode{}
+		slice := []interface{}{"leaf"}
+		for i := 0; i < 30; i++ {
+			node = &testNode{Left: node, Right: node}
+			slice = []interface{}{slice, slice}
+		}
+
+		config := types.DefaultConfig()
+		config.MaxValueDepth = 64
+		for name, data := range map[string]interface{}{
+			"pointers": node,
+			"slices":   slice,
+		} {
+			data := data
+			t.Run(name, func(t *testing.T) {
+				var s testSink
+				n, stats, err := marshal.NewEncoder(config).Encode(data, &s)
+				require.NoError(t, err)
+				require.Empty(t, s.containers)
+				require.Zero(t, stats.Cycles)
+				require.NotZero(t, stats.RepeatedRefs)
+				// Every repeated reference encoded again results in at most
+				// three values, besides the values of the first path
+				require.True(t, n <= 3*(types.MaxRepeatedRefs+31), n)
+			})
+		}
+	})
+
+	t.Run("marshalers", func(t *testing.T) {
+		var s testSink
+		_, _, err := testEncoder().Encode(types.DataSet{
+			"ip":    net.IPv4(127, 0, 0, 1),
+			"panic": testPanickingStringer{},
+		}, &s)
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{"ip": "127.0.0."}, s.v)
+	})
+
+	t.Run("encodable error", func(t *testing.T) {
+		var s testSink
+		_, stats, err := testEncoder().Encode(types.DataSet{
+			"a": testFailingEncodable{},
+			"b": "v",
+		}, &s)
+		require.NoError(t, err)
+		// The value built before the error is not added
+		require.Equal(t, map[string]interface{}{"b": "v"}, s.v)
+		require.Equal(t, 1, stats.UnsupportedValues)
+		require.Empty(t, s.containers)
+	})
+
+	t.Run("sink error", func(t *testing.T) {
+		s := testSink{fail: "fail"}
+		_, _, err := testEncoder().Encode(types.DataSet{
+			"a": []interface{}{map[string]interface{}{"b": "fail"}},
+		}, &s)
+		require.Equal(t, errTestSink, err)
+		// The containers started are discarded
+		require.Empty(t, s.containers)
+	})
+
+	t.Run("data error", func(t *testing.T) {
+		var s testSink
+		n, stats, err := testEncoder().Encode(func() {}, &s)
+		require.Equal(t, marshal.ErrUnsupportedValue, err)
+		require.Equal(t, 0, n)
+		require.Equal(t, 1, stats.UnsupportedValues)
+		require.Nil(t, s.v)
+	})
+
+	t.Run("encodable value at max depth", func(t *testing.T) {
+		deep := func(v interface{}) types.DataSet {
+			return types.DataSet{"a": []interface{}{[]interface{}{[]interface{}{v}}}}
+		}
+
+		var stringSink testSink
+		_, stringStats, err := testEncoder().Encode(deep(testEncodable("v")), &stringSink)
+		require.NoError(t, err)
+
+		var valueSink testSink
+		_, valueStats, err := testEncoder().Encode(deep(testValueEncodable{"v"}), &valueSink)
+		require.NoError(t, err)
+
+		require.Equal(t, deep("v"), types.DataSet(stringSink.v.(map[string]interface{})))
+		require.Equal(t, stringSink.v, valueSink.v)
+		require.True(t, stringStats.Complete())
+		require.True(t, valueStats.Complete())
+	})
+
+	t.Run("encodable delegation cycle", func(t *testing.T) {
+		var s testSink
+		_, stats, err := testEncoder().Encode(types.DataSet{
+			"a": testValueEncodable{testValueEncodable{"v"}},
+			"b": testValueEncodable{&testPointerEncodable{"v"}},
+			"c": testValueEncodable{[]interface{}{testValueEncodable{"v"}}},
+			"d": testRecursiveEncodable{},
+		}, &s)
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{
+			"b": "v",
+			"c": []interface{}{"v"},
+		}, s.v)
+		require.Equal(t, 2, stats.Cycles)
+		require.ElementsMatch(t, []types.EncodeEvent{
+			{Issue: types.EncodeCycle, KeyPath: []string{"a"}},
+			{Issue: types.EncodeCycle, KeyPath: []string{"d"}},
+		}, stats.Events)
+		require.Empty(t, s.containers)
+	})
+}
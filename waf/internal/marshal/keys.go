@@ -0,0 +1,187 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// MapIter iterates over the entries of a map value. Maps having more entries
+// than their maximum length are iterated in the order of KeyLess so that the
+// same entries are always kept when truncated. Other maps are iterated in
+// the random map order, which is cheaper.
+type MapIter struct {
+	m       reflect.Value
+	iter    *reflect.MapIter
+	options KeyOptions
+	// Sorted keys, their strings and the index of the current one, when
+	// truncated
+	keys  []reflect.Value
+	strs  []string
+	valid []bool
+	i     int
+}
+
+// NewMapIter returns the iterator of the map value having the given maximum
+// length and priority keys, whose keys are converted into strings according
+// to the key options.
+func NewMapIter(m reflect.Value, maxLength int, priority []string, options KeyOptions) MapIter {
+	if m.Len() <= maxLength {
+		return MapIter{iter: m.MapRange(), options: options}
+	}
+	keys := m.MapKeys()
+	strs := make([]string, len(keys))
+	valid := make([]bool, len(keys))
+	for i, k := range keys {
+		strs[i], valid[i] = options.String(k)
+	}
+	sort.Sort(mapKeys{keys: keys, strs: strs, valid: valid, priority: priority})
+	return MapIter{m: m, options: options, keys: keys, strs: strs, valid: valid, i: -1}
+}
+
+// Next advances the iterator and returns false when there are no more
+// entries.
+func (it *MapIter) Next() bool {
+	if it.iter != nil {
+		return it.iter.Next()
+	}
+	it.i++
+	return it.i < len(it.keys)
+}
+
+// Key returns the key of the current entry.
+func (it *MapIter) Key() reflect.Value {
+	if it.iter != nil {
+		return it.iter.Key()
+	}
+	return it.keys[it.i]
+}
+
+// StringKey returns the string of the key of the current entry. ok is false
+// when the key cannot be converted into a string.
+func (it *MapIter) StringKey() (key string, ok bool) {
+	if it.iter != nil {
+		return it.options.String(it.iter.Key())
+	}
+	return it.strs[it.i], it.valid[it.i]
+}
+
+// Value returns the value of the current entry.
+func (it *MapIter) Value() reflect.Value {
+	if it.iter != nil {
+		return it.iter.Value()
+	}
+	return it.m.MapIndex(it.keys[it.i])
+}
+
+// KeyOptions tells how map keys are converted into strings.
+type KeyOptions struct {
+	// Strict only accepts string keys.
+	Strict bool
+	// Marshalers is the ordered list of marshaler interfaces keys can
+	// implement. The JSON marshaler is not used for keys.
+	Marshalers []types.Marshaler
+}
+
+// String returns the string of the map key value, which can be a pointer or
+// interface to the key. String keys are used as is. Unless strict, other keys
+// are converted using the first marshaler they implement, or formatted in base
+// 10 for integers, and as `true` or `false` for booleans. ok is false for
+// other keys, nil keys and when the marshaler fails.
+func (o KeyOptions) String(v reflect.Value) (key string, ok bool) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "", false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.String {
+		return v.String(), true
+	}
+	if o.Strict {
+		return "", false
+	}
+
+	if str, ok, err := marshalString(v, o.Marshalers, true); ok {
+		return str, err == nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10), true
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), true
+	default:
+		return "", false
+	}
+}
+
+// mapKeys sorts map keys according to KeyLess, followed by the keys having
+// no string.
+type mapKeys struct {
+	keys     []reflect.Value
+	strs     []string
+	valid    []bool
+	priority []string
+}
+
+func (k mapKeys) Len() int { return len(k.keys) }
+
+func (k mapKeys) Less(i, j int) bool {
+	if k.valid[i] != k.valid[j] {
+		return k.valid[i]
+	}
+	return KeyLess(k.strs[i], k.strs[j], k.priority)
+}
+
+func (k mapKeys) Swap(i, j int) {
+	k.keys[i], k.keys[j] = k.keys[j], k.keys[i]
+	k.strs[i], k.strs[j] = k.strs[j], k.strs[i]
+	k.valid[i], k.valid[j] = k.valid[j], k.valid[i]
+}
+
+// KeyLess returns true when the map key a is kept before b when truncating a
+// map: the priority keys come first in their order, followed by the other
+// keys in lexicographical order.
+func KeyLess(a, b string, priority []string) bool {
+	pa, pb := priorityRank(a, priority), priorityRank(b, priority)
+	if pa != pb {
+		return pa < pb
+	}
+	return a < b
+}
+
+// priorityRank returns the index of the key in the priority list, or its
+// length when not found. Priority lists are expected to be short.
+func priorityRank(key string, priority []string) int {
+	for i, p := range priority {
+		if p == key {
+			return i
+		}
+	}
+	return len(priority)
+}
+
+// PriorityFields returns the struct fields in the order they are kept when
+// truncating the struct: the fields named after the priority keys come first
+// in their order, followed by the other fields in their declaration order.
+// The given slice is not modified.
+func PriorityFields(fields []Field, priority []string) []Field {
+	if len(priority) == 0 {
+		return fields
+	}
+	sorted := make([]Field, len(fields))
+	copy(sorted, fields)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return priorityRank(sorted[i].Name, priority) < priorityRank(sorted[j].Name, priority)
+	})
+	return sorted
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/marshal"
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapIter(t *testing.T) {
+	keys := func(m interface{}, maxLength int, priority []string) (keys []interface{}) {
+		v := reflect.ValueOf(m)
+		iter := marshal.NewMapIter(v, maxLength, priority, marshal.KeyOptions{})
+		for iter.Next() {
+			require.Equal(t, v.MapIndex(iter.Key()).Interface(), iter.Value().Interface())
+			key, ok := iter.StringKey()
+			expectedKey, expectedOK := marshal.KeyOptions{}.String(iter.Key())
+			require.Equal(t, expectedKey, key)
+			require.Equal(t, expectedOK, ok)
+			keys = append(keys, iter.Key().Interface())
+		}
+		return keys
+	}
+
+	m := map[string]int{"d": 1, "b": 2, "query": 3, "a": 4, "body": 5}
+
+	t.Run("not truncated", func(t *testing.T) {
+		require.ElementsMatch(t, []interface{}{"a", "b", "d", "query", "body"}, keys(m, 5, nil))
+	})
+
+	t.Run("sorted", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			require.Equal(t, []interface{}{"a", "b", "body", "d", "query"}, keys(m, 4, nil))
+		}
+	})
+
+	t.Run("priority keys", func(t *testing.T) {
+		require.Equal(t, []interface{}{"query", "body", "a", "b", "d"}, keys(m, 4, []string{"query", "missing", "body"}))
+	})
+
+	t.Run("non-string keys", func(t *testing.T) {
+		str := "b"
+		m := map[interface{}]int{1.5: 1, "c": 2, &str: 3, "a": 4, 10: 5}
+		sorted := keys(m, 1, nil)
+		require.Equal(t, []interface{}{10, "a", &str, "c"}, sorted[:4])
+		require.Equal(t, 1.5, sorted[4])
+	})
+}
+
+type testKeyMarshalers int
+
+func (testKeyMarshalers) MarshalText() ([]byte, error) { return []byte("text"), nil }
+func (testKeyMarshalers) MarshalJSON() ([]byte, error) { return []byte(`"json"`), nil }
+func (testKeyMarshalers) String() string               { return "stringer" }
+
+type testKeyStringer struct{ id int }
+
+func (k *testKeyStringer) String() string { return fmt.Sprintf("id-%d", k.id) }
+
+type testFailingKeyMarshaler int
+
+func (testFailingKeyMarshaler) MarshalText() ([]byte, error) { return nil, errors.New("oops") }
+
+func TestKeyOptions(t *testing.T) {
+	str := "pointer"
+	var iface interface{} = "interface"
+	for _, tc := range []struct {
+		Name          string
+		Key           interface{}
+		Options       marshal.KeyOptions
+		ExpectedKey   string
+		ExpectedNotOK bool
+	}{
+		{Name: "string", Key: "key", ExpectedKey: "key"},
+		{Name: "string pointer", Key: &str, ExpectedKey: "pointer"},
+		{Name: "interface pointer", Key: &iface, ExpectedKey: "interface"},
+		{Name: "nil pointer", Key: (*string)(nil), ExpectedNotOK: true},
+		{Name: "int", Key: -12, ExpectedKey: "-12"},
+		{Name: "int8", Key: int8(-8), ExpectedKey: "-8"},
+		{Name: "uint64", Key: uint64(1 << 63), ExpectedKey: "9223372036854775808"},
+		{Name: "uintptr", Key: uintptr(7), ExpectedKey: "7"},
+		{Name: "bool", Key: true, ExpectedKey: "true"},
+		{Name: "float", Key: 1.5, ExpectedNotOK: true},
+		{Name: "struct", Key: struct{}{}, ExpectedNotOK: true},
+		{Name: "strict string", Key: "key", Options: marshal.KeyOptions{Strict: true}, ExpectedKey: "key"},
+		{Name: "strict int", Key: 1, Options: marshal.KeyOptions{Strict: true}, ExpectedNotOK: true},
+		{Name: "text marshaler", Key: testKeyMarshalers(1), Options: marshal.KeyOptions{Marshalers: types.DefaultMarshalers()}, ExpectedKey: "text"},
+		{Name: "json marshaler not used", Key: testKeyMarshalers(1), Options: marshal.KeyOptions{Marshalers: []types.Marshaler{types.MarshalerJSON, types.MarshalerString}}, ExpectedKey: "stringer"},
+		{Name: "no marshalers", Key: testKeyMarshalers(1), ExpectedKey: "1"},
+		{Name: "pointer receiver", Key: testKeyStringer{id: 1}, Options: marshal.KeyOptions{Marshalers: types.DefaultMarshalers()}, ExpectedKey: "id-1"},
+		{Name: "failing marshaler", Key: testFailingKeyMarshaler(1), Options: marshal.KeyOptions{Marshalers: types.DefaultMarshalers()}, ExpectedNotOK: true},
+		{Name: "panicking marshaler", Key: testPanickingStringer{}, Options: marshal.KeyOptions{Marshalers: types.DefaultMarshalers()}, ExpectedNotOK: true},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			key, ok := tc.Options.String(reflect.ValueOf(tc.Key))
+			require.Equal(t, !tc.ExpectedNotOK, ok)
+			require.Equal(t, tc.ExpectedKey, key)
+		})
+	}
+}
+
+func TestPriorityFields(t *testing.T) {
+	fields := marshal.StructFields(reflect.TypeOf(struct {
+		A, B, Query, C, Body string
+	}{}), false)
+
+	names := func(fields []marshal.Field) (names []string) {
+		for _, f := range fields {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	require.Equal(t, []string{"Body", "Query", "A", "B", "C"}, names(marshal.PriorityFields(fields, []string{"Body", "Query"})))
+	// The struct layout is not modified
+	require.Equal(t, []string{"A", "B", "Query", "C", "Body"}, names(fields))
+	require.Equal(t, []string{"A", "B", "Query", "C", "Body"}, names(marshal.PriorityFields(fields, nil)))
+}
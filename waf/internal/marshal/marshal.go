@@ -0,0 +1,139 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+var (
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	stringerType      = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+// implementation tells how a type implements a marshaler interface.
+type implementation uint8
+
+const (
+	notImplemented implementation = iota
+	// The type implements the interface.
+	valueImplementation
+	// Only the pointer to the type implements the interface.
+	pointerImplementation
+)
+
+// Marshaler implementations of the types, indexed by marshaler.
+var implementations sync.Map // map[reflect.Type][]implementation
+
+func typeImplementations(t reflect.Type) []implementation {
+	if impls, ok := implementations.Load(t); ok {
+		return impls.([]implementation)
+	}
+	impls := make([]implementation, types.MarshalerString+1)
+	for m, it := range []reflect.Type{
+		types.MarshalerText:   textMarshalerType,
+		types.MarshalerJSON:   jsonMarshalerType,
+		types.MarshalerString: stringerType,
+	} {
+		if t.Implements(it) {
+			impls[m] = valueImplementation
+		} else if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(it) {
+			impls[m] = pointerImplementation
+		}
+	}
+	implementations.Store(t, impls)
+	return impls
+}
+
+// String returns the string of the value using the first marshaler of the
+// list it implements, including through a pointer receiver. ok is false when
+// the value implements none of them, is a nil pointer, or is an interface
+// value which is rather expected to be passed once unwrapped. A non-nil error
+// is returned when the marshaler failed or panicked. json.RawMessage values are
+// not marshaled as they are rather expected to be encoded verbatim.
+func String(v reflect.Value, marshalers []types.Marshaler) (str string, ok bool, err error) {
+	return marshalString(v, marshalers, false)
+}
+
+// marshalString is String optionally skipping the JSON marshaler, whose JSON
+// texts are not meaningful map keys.
+func marshalString(v reflect.Value, marshalers []types.Marshaler, skipJSON bool) (str string, ok bool, err error) {
+	if len(marshalers) == 0 || !v.IsValid() || !v.CanInterface() {
+		return "", false, nil
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		return "", false, nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			return "", false, nil
+		}
+	}
+
+	if v.Type() == rawMessageType {
+		// Kept verbatim as bytes
+		return "", false, nil
+	}
+
+	impls := typeImplementations(v.Type())
+	for _, m := range marshalers {
+		if skipJSON && m == types.MarshalerJSON {
+			continue
+		}
+		switch impls[m] {
+		case notImplemented:
+			continue
+		case pointerImplementation:
+			if v.CanAddr() {
+				v = v.Addr()
+			} else {
+				p := reflect.New(v.Type())
+				p.Elem().Set(v)
+				v = p
+			}
+		}
+		str, err = call(m, v.Interface())
+		return str, true, err
+	}
+	return "", false, nil
+}
+
+func call(m types.Marshaler, v interface{}) (str string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s marshaler panic: %v", m, r)
+		}
+	}()
+
+	switch m {
+	case types.MarshalerText:
+		b, err := v.(encoding.TextMarshaler).MarshalText()
+		return string(b), err
+
+	case types.MarshalerJSON:
+		b, err := v.(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return "", err
+		}
+		// JSON strings are unquoted while other JSON values are kept as is
+		if len(b) > 0 && b[0] == '"' {
+			var s string
+			if err := json.Unmarshal(b, &s); err == nil {
+				return s, nil
+			}
+		}
+		return string(b), nil
+
+	default:
+		return v.(fmt.Stringer).String(), nil
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/marshal"
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+type testJSONMarshaler string
+
+func (m testJSONMarshaler) MarshalJSON() ([]byte, error) {
+	if !json.Valid([]byte(m)) {
+		return nil, errors.New("invalid json")
+	}
+	return []byte(m), nil
+}
+
+type testPanickingStringer struct{}
+
+func (testPanickingStringer) String() string { panic("oops") }
+
+type testMarshalers struct{}
+
+func (testMarshalers) MarshalText() ([]byte, error) { return []byte("text"), nil }
+func (testMarshalers) MarshalJSON() ([]byte, error) { return []byte(`"json"`), nil }
+func (testMarshalers) String() string               { return "stringer" }
+
+func TestString(t *testing.T) {
+	for _, tc := range []struct {
+		Name           string
+		Data           interface{}
+		Marshalers     []types.Marshaler
+		ExpectedString string
+		ExpectedNotOK  bool
+		ExpectedError  bool
+	}{
+		{Name: "time", Data: time.Time{}, ExpectedString: "0001-01-01T00:00:00Z"},
+		{Name: "time without marshalers", Data: time.Time{}, Marshalers: []types.Marshaler{}, ExpectedNotOK: true},
+		{Name: "ip", Data: net.IPv4(127, 0, 0, 1), ExpectedString: "127.0.0.1"},
+		{Name: "pointer receiver", Data: url.URL{Scheme: "https", Host: "sqreen.io", Path: "/"}, ExpectedString: "https://sqreen.io/"},
+		{Name: "pointer", Data: &url.URL{Scheme: "https", Host: "sqreen.io", Path: "/"}, ExpectedString: "https://sqreen.io/"},
+		{Name: "nil pointer", Data: (*url.URL)(nil), ExpectedNotOK: true},
+		{Name: "not implemented", Data: struct{}{}, ExpectedNotOK: true},
+		{Name: "json not a default", Data: testJSONMarshaler(`"quoted"`), ExpectedNotOK: true},
+		{Name: "json string", Data: testJSONMarshaler(`"quoted"`), Marshalers: []types.Marshaler{types.MarshalerJSON}, ExpectedString: "quoted"},
+		{Name: "json object", Data: testJSONMarshaler(`{"k":1}`), Marshalers: []types.Marshaler{types.MarshalerJSON}, ExpectedString: `{"k":1}`},
+		{Name: "failing marshaler", Data: testJSONMarshaler(`{ oops`), Marshalers: []types.Marshaler{types.MarshalerJSON}, ExpectedError: true},
+		{Name: "panicking marshaler", Data: testPanickingStringer{}, ExpectedError: true},
+		{Name: "default priority", Data: testMarshalers{}, ExpectedString: "text"},
+		{Name: "custom priority", Data: testMarshalers{}, Marshalers: []types.Marshaler{types.MarshalerJSON, types.MarshalerText}, ExpectedString: "json"},
+		{Name: "stringer only", Data: testMarshalers{}, Marshalers: []types.Marshaler{types.MarshalerString}, ExpectedString: "stringer"},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			marshalers := types.DefaultMarshalers()
+			if tc.Marshalers != nil {
+				marshalers = tc.Marshalers
+			}
+			str, ok, err := marshal.String(reflect.ValueOf(tc.Data), marshalers)
+			if tc.ExpectedNotOK {
+				require.False(t, ok)
+				require.NoError(t, err)
+				return
+			}
+			require.True(t, ok)
+			if tc.ExpectedError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.ExpectedString, str)
+		})
+	}
+
+	t.Run("interface values", func(t *testing.T) {
+		// Interface values are expected to be unwrapped first
+		m := map[string]fmt.Stringer{"k": time.Second}
+		_, ok, _ := marshal.String(reflect.ValueOf(m).MapIndex(reflect.ValueOf("k")), types.DefaultMarshalers())
+		require.False(t, ok)
+	})
+
+	t.Run("addressable values", func(t *testing.T) {
+		s := []url.URL{{Scheme: "https", Host: "sqreen.io", Path: "/"}}
+		str, ok, err := marshal.String(reflect.ValueOf(s).Index(0), types.DefaultMarshalers())
+		require.True(t, ok)
+		require.NoError(t, err)
+		require.Equal(t, "https://sqreen.io/", str)
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+var (
+	bigIntType   = reflect.TypeOf(big.Int{})
+	bigFloatType = reflect.TypeOf(big.Float{})
+)
+
+// Float returns the string of the float value v when it is not encoded as an
+// integer according to the float encoding, along with true. Otherwise, it
+// returns the rounded integer value along with false.
+func Float(v reflect.Value, encoding types.FloatEncoding) (str string, n int64, isString bool) {
+	bitSize := 64
+	if v.Kind() == reflect.Float32 {
+		bitSize = 32
+	}
+	return FloatValue(v.Float(), bitSize, encoding)
+}
+
+// FloatValue is similar to Float for a float value of the given bit size.
+func FloatValue(f float64, bitSize int, encoding types.FloatEncoding) (str string, n int64, isString bool) {
+	switch {
+	case math.IsNaN(f):
+		return "NaN", 0, true
+	case math.IsInf(f, 1):
+		return "+Inf", 0, true
+	case math.IsInf(f, -1):
+		return "-Inf", 0, true
+	}
+
+	if encoding == types.FloatRounded {
+		// Floats in the int64 range, knowing 2^63 is exactly representable
+		if r := math.Round(f); r >= math.MinInt64 && r < math.MaxInt64 {
+			return "", int64(r), false
+		}
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, bitSize), 0, true
+}
+
+// BigNumber returns the decimal string of big.Int and big.Float values.
+func BigNumber(v reflect.Value) (string, bool) {
+	if v.Kind() != reflect.Struct || !v.CanInterface() {
+		return "", false
+	}
+	switch v.Type() {
+	case bigIntType:
+		n := bigValue(v).Interface().(*big.Int)
+		return n.String(), true
+	case bigFloatType:
+		f := bigValue(v).Interface().(*big.Float)
+		return f.Text('g', -1), true
+	}
+	return "", false
+}
+
+// bigValue returns the pointer to the big number value, as their methods have
+// pointer receivers.
+func bigValue(v reflect.Value) reflect.Value {
+	if v.CanAddr() {
+		return v.Addr()
+	}
+	p := reflect.New(v.Type())
+	p.Elem().Set(v)
+	return p
+}
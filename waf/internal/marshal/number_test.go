@@ -0,0 +1,70 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal_test
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/marshal"
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFloat(t *testing.T) {
+	for _, tc := range []struct {
+		Name           string
+		Data           interface{}
+		FloatEncoding  types.FloatEncoding
+		ExpectedString string
+		ExpectedInt    int64
+	}{
+		{Name: "rounded", Data: 33.5, ExpectedInt: 34},
+		{Name: "rounded negative", Data: -0.4, ExpectedInt: 0},
+		{Name: "rounded float32", Data: float32(2.5), ExpectedInt: 3},
+		{Name: "rounded max int64", Data: float64(math.MaxInt64), ExpectedString: "9.223372036854776e+18"},
+		{Name: "rounded min int64", Data: float64(math.MinInt64), ExpectedInt: math.MinInt64},
+		{Name: "rounded big float", Data: 1.0e308, ExpectedString: "1e+308"},
+		{Name: "rounded nan", Data: math.NaN(), ExpectedString: "NaN"},
+		{Name: "rounded infinity", Data: math.Inf(1), ExpectedString: "+Inf"},
+		{Name: "string", Data: 33.5, FloatEncoding: types.FloatString, ExpectedString: "33.5"},
+		{Name: "string integer", Data: 33.0, FloatEncoding: types.FloatString, ExpectedString: "33"},
+		{Name: "string float32", Data: float32(0.1), FloatEncoding: types.FloatString, ExpectedString: "0.1"},
+		{Name: "string small", Data: 1e-7, FloatEncoding: types.FloatString, ExpectedString: "1e-07"},
+		{Name: "string negative infinity", Data: math.Inf(-1), FloatEncoding: types.FloatString, ExpectedString: "-Inf"},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			str, n, isString := marshal.Float(reflect.ValueOf(tc.Data), tc.FloatEncoding)
+			require.Equal(t, tc.ExpectedString != "", isString)
+			require.Equal(t, tc.ExpectedString, str)
+			require.Equal(t, tc.ExpectedInt, n)
+		})
+	}
+}
+
+func TestBigNumber(t *testing.T) {
+	n, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	for _, tc := range []struct {
+		Name           string
+		Data           reflect.Value
+		ExpectedString string
+	}{
+		{Name: "int", Data: reflect.ValueOf(*n), ExpectedString: n.String()},
+		{Name: "addressable int", Data: reflect.ValueOf(n).Elem(), ExpectedString: n.String()},
+		{Name: "float", Data: reflect.ValueOf(*big.NewFloat(0.1)), ExpectedString: "0.1"},
+		{Name: "int pointer", Data: reflect.ValueOf(n)},
+		{Name: "other struct", Data: reflect.ValueOf(struct{}{})},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			str, ok := marshal.BigNumber(tc.Data)
+			require.Equal(t, tc.ExpectedString != "", ok)
+			require.Equal(t, tc.ExpectedString, str)
+		})
+	}
+}
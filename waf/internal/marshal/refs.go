@@ -0,0 +1,92 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal
+
+import "reflect"
+
+// Refs is the set of the pointers, maps and slices on the path of the value
+// being encoded, used to detect the values referencing one of their parents.
+// Values referenced several times without cycle, such as shared
+// sub-structures, are not considered cycles as only the current path is
+// tracked, but are reported as repeated once left. The zero value is an empty
+// set.
+type Refs struct {
+	refs map[ref]struct{}
+	// References left so far
+	left map[ref]struct{}
+}
+
+// ref identifies a reference value. The pointer type is part of it because a
+// pointer to a struct and a pointer to its first field have the same address,
+// and the slice length because a slice and its sub-slices share the same
+// array. Map and slice types are ignored so that a value is identified
+// regardless of its named type.
+type ref struct {
+	ptr uintptr
+	len int
+	typ reflect.Type
+}
+
+// Enter adds the value to the current path when it is a pointer, map or slice
+// value. It returns false when it is already in the path, in which case it is
+// a cycle and must not be encoded. Otherwise, Leave must be called once the
+// value is encoded.
+func (r *Refs) Enter(v reflect.Value) bool {
+	k, ok := refOf(v)
+	if !ok {
+		return true
+	}
+	if _, exists := r.refs[k]; exists {
+		return false
+	}
+	if r.refs == nil {
+		r.refs = map[ref]struct{}{}
+	}
+	r.refs[k] = struct{}{}
+	return true
+}
+
+// Leave removes the value from the current path.
+func (r *Refs) Leave(v reflect.Value) {
+	if k, ok := refOf(v); ok {
+		delete(r.refs, k)
+		if r.left == nil {
+			r.left = map[ref]struct{}{}
+		}
+		r.left[k] = struct{}{}
+	}
+}
+
+// Repeated returns true when the value is a pointer, map or slice value which
+// was already entered and left, such as a sub-structure shared by several
+// values.
+func (r *Refs) Repeated(v reflect.Value) bool {
+	k, ok := refOf(v)
+	if !ok {
+		return false
+	}
+	_, repeated := r.left[k]
+	return repeated
+}
+
+// refOf returns the reference of the value, if any. Nil and empty values
+// cannot reference other values and are therefore ignored.
+func refOf(v reflect.Value) (ref, bool) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return ref{}, false
+		}
+		return ref{ptr: v.Pointer(), typ: v.Type()}, true
+	case reflect.Map, reflect.Slice:
+		l := v.Len()
+		if l == 0 {
+			return ref{}, false
+		}
+		return ref{ptr: v.Pointer(), len: l}, true
+	default:
+		return ref{}, false
+	}
+}
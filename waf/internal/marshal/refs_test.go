@@ -0,0 +1,60 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/marshal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefs(t *testing.T) {
+	type node struct {
+		first int
+		next  *node
+	}
+
+	t.Run("pointers", func(t *testing.T) {
+		var refs marshal.Refs
+		n := &node{}
+		v := reflect.ValueOf(n)
+		require.True(t, refs.Enter(v))
+		require.False(t, refs.Enter(v))
+		// Same address but different type
+		require.True(t, refs.Enter(reflect.ValueOf(&n.first)))
+		refs.Leave(reflect.ValueOf(&n.first))
+		require.False(t, refs.Repeated(v))
+		refs.Leave(v)
+		require.True(t, refs.Repeated(v))
+		require.True(t, refs.Enter(v))
+		require.False(t, refs.Repeated(reflect.ValueOf(&node{})))
+	})
+
+	t.Run("maps and slices", func(t *testing.T) {
+		var refs marshal.Refs
+		m := map[string]interface{}{"a": 1}
+		require.True(t, refs.Enter(reflect.ValueOf(m)))
+		require.False(t, refs.Enter(reflect.ValueOf(m)))
+		// Same map having another named type
+		type namedMap map[string]interface{}
+		require.False(t, refs.Enter(reflect.ValueOf(namedMap(m))))
+
+		s := []interface{}{1, 2}
+		require.True(t, refs.Enter(reflect.ValueOf(s)))
+		require.False(t, refs.Enter(reflect.ValueOf(s)))
+		// Sub-slice sharing the same array
+		require.True(t, refs.Enter(reflect.ValueOf(s[:1])))
+	})
+
+	t.Run("ignored values", func(t *testing.T) {
+		var refs marshal.Refs
+		for _, v := range []interface{}{(*node)(nil), map[string]int{}, []int(nil), "a", 1, node{}} {
+			require.True(t, refs.Enter(reflect.ValueOf(v)))
+			require.True(t, refs.Enter(reflect.ValueOf(v)))
+		}
+	})
+}
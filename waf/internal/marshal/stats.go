@@ -0,0 +1,79 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal
+
+import (
+	"strconv"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// Stats records the encoding statistics while keeping track of the key path
+// of the value being encoded.
+type Stats struct {
+	types.EncodeStats
+	path []pathElement
+}
+
+// pathElement is either a map key or an array index, which is only formatted
+// when recording an event.
+type pathElement struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// Reset the statistics and key path.
+func (s *Stats) Reset() {
+	s.EncodeStats = types.EncodeStats{}
+	s.path = s.path[:0]
+}
+
+// PushKey appends the map key to the current key path.
+func (s *Stats) PushKey(key string) {
+	s.path = append(s.path, pathElement{key: key})
+}
+
+// PushIndex appends the array index to the current key path.
+func (s *Stats) PushIndex(index int) {
+	s.path = append(s.path, pathElement{index: index, isIndex: true})
+}
+
+// Pop removes the last element of the current key path.
+func (s *Stats) Pop() {
+	s.path = s.path[:len(s.path)-1]
+}
+
+// Record n occurrences of the issue for the value at the current key path.
+func (s *Stats) Record(issue types.EncodeIssue, n int) {
+	switch issue {
+	case types.EncodeTruncatedString:
+		s.TruncatedStrings += n
+	case types.EncodeDroppedArrayEntries:
+		s.DroppedArrayEntries += n
+	case types.EncodeDroppedMapEntries:
+		s.DroppedMapEntries += n
+	case types.EncodeDepthCutoff:
+		s.DepthCutoffs += n
+	case types.EncodeUnsupportedValue:
+		s.UnsupportedValues += n
+	case types.EncodeCycle:
+		s.Cycles += n
+	case types.EncodeRepeatedRef:
+		s.RepeatedRefs += n
+	}
+	if len(s.Events) >= types.MaxEncodeEvents {
+		return
+	}
+	keyPath := make([]string, len(s.path))
+	for i, e := range s.path {
+		if e.isIndex {
+			keyPath[i] = strconv.Itoa(e.index)
+		} else {
+			keyPath[i] = e.key
+		}
+	}
+	s.Events = append(s.Events, types.EncodeEvent{Issue: issue, KeyPath: keyPath})
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Field is a struct field encoded into a WAF map entry.
+type Field struct {
+	// Name is the map key of the field.
+	Name string
+	// Index is the index sequence of the field, possibly in embedded structs.
+	Index []int
+	// OmitEmpty is true when the field is not encoded when empty.
+	OmitEmpty bool
+
+	// Whether the name comes from a tag
+	tagged bool
+}
+
+// Value returns the value of the field in the struct value v. ok is false when
+// the field is in an embedded struct through a nil pointer.
+func (f *Field) Value(v reflect.Value) (_ reflect.Value, ok bool) {
+	for i, x := range f.Index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+type structLayoutKey struct {
+	t               reflect.Type
+	jsonTagFallback bool
+}
+
+// Struct layouts already computed.
+var structLayouts sync.Map // map[structLayoutKey][]Field
+
+// StructFields returns the fields of the struct type to encode, in the order
+// of their declaration. The `waf` field tag sets the field name and options,
+// in the same format as the `json` tag:
+//
+//   - `waf:"name"` sets the map key of the field.
+//   - `waf:",omitempty"` omits the field when it has an empty value.
+//   - `waf:"-"` always omits the field.
+//
+// The `json` tag of the field is used when it has no `waf` tag and
+// jsonTagFallback is true. Unexported fields are omitted, and the fields of
+// embedded structs without tag name are flattened into the struct, following
+// the same visibility rules as the encoding/json package.
+//
+// The returned slice is shared and must not be modified.
+func StructFields(t reflect.Type, jsonTagFallback bool) []Field {
+	key := structLayoutKey{t: t, jsonTagFallback: jsonTagFallback}
+	if fields, ok := structLayouts.Load(key); ok {
+		return fields.([]Field)
+	}
+	fields := structFields(t, jsonTagFallback)
+	structLayouts.Store(key, fields)
+	return fields
+}
+
+func structFields(t reflect.Type, jsonTagFallback bool) []Field {
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+
+	var (
+		fields []Field
+		// Number of fields per name at the current depth
+		count map[string]int
+		// Embedded structs to visit at the next depth
+		next = []embedded{{t: t}}
+		// Struct types already visited at lower depths
+		visited = map[reflect.Type]bool{}
+		// Names already defined at lower depths
+		names = map[string]bool{}
+	)
+
+	// Breadth-first traversal of the embedded structs so that the fields of
+	// lower depths take precedence over the deeper ones.
+	for len(next) > 0 {
+		current := next
+		next = nil
+		count = map[string]int{}
+		var depthFields []Field
+
+		for _, s := range current {
+			if visited[s.t] {
+				continue
+			}
+			visited[s.t] = true
+
+			for i := 0; i < s.t.NumField(); i++ {
+				sf := s.t.Field(i)
+				index := make([]int, len(s.index)+1)
+				copy(index, s.index)
+				index[len(s.index)] = i
+
+				tag, ok := sf.Tag.Lookup("waf")
+				if !ok && jsonTagFallback {
+					tag = sf.Tag.Get("json")
+				}
+				if tag == "-" {
+					continue
+				}
+				name, opts := parseTag(tag)
+
+				if sf.Anonymous && name == "" {
+					ft := sf.Type
+					if ft.Kind() == reflect.Ptr {
+						ft = ft.Elem()
+					}
+					if ft.Kind() == reflect.Struct {
+						next = append(next, embedded{t: ft, index: index})
+						continue
+					}
+				}
+				if sf.PkgPath != "" {
+					// Unexported field
+					continue
+				}
+
+				f := Field{
+					Name:      name,
+					Index:     index,
+					OmitEmpty: opts.contains("omitempty"),
+					tagged:    name != "",
+				}
+				if f.Name == "" {
+					f.Name = sf.Name
+				}
+				if names[f.Name] {
+					// Hidden by a field of a lower depth
+					continue
+				}
+				count[f.Name]++
+				depthFields = append(depthFields, f)
+			}
+		}
+
+		// Resolve the name conflicts of this depth: a single tagged field wins,
+		// otherwise every conflicting field is omitted.
+		for _, f := range depthFields {
+			if count[f.Name] > 1 && !dominantField(f, depthFields) {
+				continue
+			}
+			fields = append(fields, f)
+		}
+		for name := range count {
+			names[name] = true
+		}
+	}
+
+	return fields
+}
+
+// dominantField returns true when f is the only tagged field of its name.
+func dominantField(f Field, fields []Field) bool {
+	if !f.tagged {
+		return false
+	}
+	for _, other := range fields {
+		if other.Name == f.Name && other.tagged && !sameIndex(other.Index, f.Index) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameIndex(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type tagOptions string
+
+func parseTag(tag string) (string, tagOptions) {
+	if i := strings.Index(tag, ","); i != -1 {
+		return tag[:i], tagOptions(tag[i+1:])
+	}
+	return tag, ""
+}
+
+func (o tagOptions) contains(name string) bool {
+	for s := string(o); s != ""; {
+		var opt string
+		if i := strings.Index(s, ","); i >= 0 {
+			opt, s = s[:i], s[i+1:]
+		} else {
+			opt, s = s, ""
+		}
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEmpty returns true when the value is empty according to the omitempty
+// option.
+func IsEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package marshal_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/marshal"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	testEmbedded struct {
+		Field    string
+		Embedded string `waf:"embedded"`
+		Conflict string
+	}
+
+	testOtherEmbedded struct {
+		Conflict string
+		Tagged   string `waf:"tagged"`
+	}
+
+	testEmbeddedPointer struct {
+		Pointer string
+	}
+
+	testTaggedEmbedded struct {
+		Tagged string `waf:"tagged"`
+	}
+)
+
+func TestStructFields(t *testing.T) {
+	for _, tc := range []struct {
+		Name            string
+		Data            interface{}
+		JSONTagFallback bool
+		ExpectedFields  map[string]string
+	}{
+		{
+			Name: "field names",
+			Data: struct {
+				Public  string
+				private string
+				_       string
+			}{Public: "public", private: "private"},
+			ExpectedFields: map[string]string{"Public": "public"},
+		},
+		{
+			Name: "waf tags",
+			Data: struct {
+				Renamed  string `waf:"renamed"`
+				Password string `waf:"-"`
+				Dash     string `waf:"-,"`
+				Omitted  string `waf:",omitempty"`
+				Kept     int    `waf:"kept,omitempty"`
+				JSON     string `json:"json"`
+			}{Renamed: "a", Password: "secret", Dash: "b", Kept: 1, JSON: "c"},
+			ExpectedFields: map[string]string{"renamed": "a", "-": "b", "kept": "1", "JSON": "c"},
+		},
+		{
+			Name: "json tag fallback",
+			Data: struct {
+				JSON     string `json:"json"`
+				Password string `json:"-"`
+				Both     string `waf:"waf" json:"json_both"`
+				Skipped  string `waf:"-" json:"skipped"`
+			}{JSON: "a", Password: "secret", Both: "b", Skipped: "c"},
+			JSONTagFallback: true,
+			ExpectedFields:  map[string]string{"json": "a", "waf": "b"},
+		},
+		{
+			Name: "embedded structs",
+			Data: struct {
+				testEmbedded
+				testOtherEmbedded
+				*testEmbeddedPointer
+				Field string
+			}{
+				testEmbedded:      testEmbedded{Field: "hidden", Embedded: "a", Conflict: "b"},
+				testOtherEmbedded: testOtherEmbedded{Conflict: "c", Tagged: "d"},
+				Field:             "e",
+			},
+			// The nil embedded pointer fields are omitted, and the conflicting
+			// fields of the same depth too.
+			ExpectedFields: map[string]string{"Field": "e", "embedded": "a", "tagged": "d"},
+		},
+		{
+			Name: "embedded struct pointers",
+			Data: struct {
+				*testEmbeddedPointer
+			}{&testEmbeddedPointer{Pointer: "a"}},
+			ExpectedFields: map[string]string{"Pointer": "a"},
+		},
+		{
+			Name: "tagged embedded struct",
+			Data: struct {
+				testTaggedEmbedded `waf:"embedded"`
+				TestTagged         testTaggedEmbedded `waf:"named"`
+			}{},
+			// The embedded struct is not flattened because of its tag name,
+			// and then omitted as it is unexported.
+			ExpectedFields: map[string]string{"named": "{}"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			v := reflect.ValueOf(tc.Data)
+			fields := map[string]string{}
+			for _, f := range marshal.StructFields(v.Type(), tc.JSONTagFallback) {
+				fv, ok := f.Value(v)
+				if !ok || f.OmitEmpty && marshal.IsEmpty(fv) {
+					continue
+				}
+				fields[f.Name] = fmt.Sprint(fv)
+			}
+			require.Equal(t, tc.ExpectedFields, fields)
+		})
+	}
+
+	t.Run("cached layout", func(t *testing.T) {
+		typ := reflect.TypeOf(testEmbedded{})
+		fields := marshal.StructFields(typ, false)
+		require.True(t, &fields[0] == &marshal.StructFields(typ, false)[0])
+		require.False(t, &fields[0] == &marshal.StructFields(typ, true)[0])
+	})
+}
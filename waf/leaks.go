@@ -0,0 +1,36 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package waf
+
+import (
+	"github.com/sqreen/go-libsqreen/waf/internal/leaks"
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// EnableLeakTracking enables the leak tracking debug mode: the rules and
+// additive contexts created from now on are tracked along with the stack trace
+// of their creation until they are closed. Those garbage collected without
+// being closed are reported to config.OnLeak, and closed when config.Release
+// is true. It has a cost on the creation of every object and is therefore
+// rather meant for tests and debugging. It can be called again to change the
+// configuration.
+func EnableLeakTracking(config types.LeakTrackingConfig) {
+	leaks.Enable(config)
+}
+
+// DisableLeakTracking disables the leak tracking debug mode and forgets the
+// tracked objects. The rules and additive contexts created while it was
+// enabled keep their finalizer until they are closed. Those garbage collected
+// without being closed are neither reported nor released, but still need an
+// extra garbage collection cycle to be freed, as any object with a finalizer.
+func DisableLeakTracking() {
+	leaks.Disable()
+}
+
+// LiveObjects returns the tracked rules and additive contexts not closed yet,
+// in creation order. It is empty when the leak tracking is disabled.
+func LiveObjects() []types.LiveObject {
+	return leaks.LiveObjects()
+}
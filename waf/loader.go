@@ -0,0 +1,183 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package waf
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// FileLoader polls a rule file and loads the rule whenever the file content
+// changes. Changes are detected by polling the file modification time and
+// size, and confirmed using the checksum of its content.
+//
+// Successfully loaded rules are published to the OnLoad callback, which takes
+// their ownership. Load failures are reported to the OnError callback and do
+// not publish anything, so that the caller keeps using its working rule.
+type FileLoader struct {
+	path     string
+	config   types.Config
+	interval time.Duration
+	onLoad   func(types.Rule, types.Diagnostics)
+	onError  func(*LoadError)
+
+	// Serializes the polls
+	mu sync.Mutex
+	// State of the file at the last poll
+	modTime  time.Time
+	size     int64
+	checksum [sha256.Size]byte
+	polled   bool
+	// Message of the last file access error reported, empty when the last
+	// access succeeded
+	accessErr string
+
+	// Serializes Start() and Stop(), the channels being nil when the polling
+	// goroutine is not running
+	runMu sync.Mutex
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// LoadError is the error reported by a FileLoader when the rule file cannot
+// be read or the rule cannot be loaded.
+type LoadError struct {
+	Path string
+	Err  error
+	// Diagnostics reported by the WAF when the rule could be read but not
+	// loaded.
+	Diagnostics types.Diagnostics
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("could not load the rule file `%s`: %v", e.Path, e.Err)
+}
+
+// DefaultLoaderInterval is the polling interval of the file loaders created
+// with a zero or negative interval.
+const DefaultLoaderInterval = time.Minute
+
+// NewFileLoader returns a loader of the rule file at the given path, polling it
+// at the given interval once started, or at DefaultLoaderInterval when it is
+// not positive. The rules are instantiated with the given configuration. The
+// callbacks are called from the loader goroutine. onError can be nil.
+func NewFileLoader(path string, config types.Config, interval time.Duration, onLoad func(types.Rule, types.Diagnostics), onError func(*LoadError)) *FileLoader {
+	if interval <= 0 {
+		interval = DefaultLoaderInterval
+	}
+	return &FileLoader{
+		path:     path,
+		config:   config,
+		interval: interval,
+		onLoad:   onLoad,
+		onError:  onError,
+	}
+}
+
+// Start polling the file in a new goroutine. The file is polled right away,
+// and then at every interval until Stop() is called. Starting an already
+// started loader has no effect.
+func (l *FileLoader) Start() {
+	l.runMu.Lock()
+	defer l.runMu.Unlock()
+	if l.stop != nil {
+		return
+	}
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.run(l.stop, l.done)
+}
+
+func (l *FileLoader) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		l.Poll()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop polling the file and wait for the polling goroutine to return. Stopping
+// a loader which is not started has no effect, and it can be started again
+// once stopped.
+func (l *FileLoader) Stop() {
+	l.runMu.Lock()
+	defer l.runMu.Unlock()
+	if l.stop == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	l.stop, l.done = nil, nil
+}
+
+// Poll checks the file once and loads the rule if its content changed since
+// the previous poll. It returns true when a new rule was published.
+func (l *FileLoader) Poll() (loaded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		l.reportAccessError(err)
+		return false
+	}
+	if l.polled && l.accessErr == "" && info.ModTime().Equal(l.modTime) && info.Size() == l.size {
+		return false
+	}
+
+	buf, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		l.reportAccessError(err)
+		return false
+	}
+	l.accessErr = ""
+	checksum := sha256.Sum256(buf)
+	changed := !l.polled || checksum != l.checksum
+	// Remember the file state even when the load fails so that the same
+	// failure is not reported again until the file changes.
+	l.polled = true
+	l.modTime = info.ModTime()
+	l.size = info.Size()
+	l.checksum = checksum
+	if !changed {
+		return false
+	}
+
+	rule, diags, err := NewRuleWithConfig(string(buf), l.config)
+	if err != nil {
+		l.reportError(&LoadError{Path: l.path, Err: err, Diagnostics: diags})
+		return false
+	}
+	l.onLoad(rule, diags)
+	return true
+}
+
+// reportAccessError reports the error of accessing the file, unless it is the
+// same as the previous one, so that a missing file is not reported at every
+// poll.
+func (l *FileLoader) reportAccessError(err error) {
+	if msg := err.Error(); msg != l.accessErr {
+		l.accessErr = msg
+		l.reportError(&LoadError{Path: l.path, Err: err})
+	}
+}
+
+func (l *FileLoader) reportError(err *LoadError) {
+	if l.onError != nil {
+		l.onError(err)
+	}
+}
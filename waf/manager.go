@@ -0,0 +1,193 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package waf
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// Manager holds the current WAF rule and allows to atomically replace it. The
+// runs and additive contexts in progress keep using the rule they started with
+// until they are done, while new ones use the latest rule. The rules are closed
+// once no longer used.
+//
+// A Manager implements types.Rule so that it can be used in place of a rule.
+type Manager struct {
+	config types.Config
+	// Serializes the updates
+	mu sync.Mutex
+	// Current rule, nil when not set yet or closed
+	current atomic.Value // *managedRule
+	// Number of successful updates
+	generation uint64
+	// True once closed
+	closed bool
+}
+
+// managedRule is a reference-counted rule, closed once the reference count
+// reaches zero.
+type managedRule struct {
+	rule       types.Rule
+	generation uint64
+	refs       int32
+}
+
+func newManagedRule(rule types.Rule, generation uint64) *managedRule {
+	return &managedRule{
+		rule:       rule,
+		generation: generation,
+		// The reference held by the manager
+		refs: 1,
+	}
+}
+
+// acquire a reference to the rule. It fails when the rule was already released.
+func (r *managedRule) acquire() bool {
+	for {
+		refs := atomic.LoadInt32(&r.refs)
+		if refs == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&r.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+func (r *managedRule) release() {
+	if atomic.AddInt32(&r.refs, -1) == 0 {
+		r.rule.Close()
+	}
+}
+
+// NewManager returns a rule manager instantiating the rules with the given
+// configuration. It has no rule until the first successful Update().
+func NewManager(config types.Config) *Manager {
+	m := &Manager{config: config}
+	m.current.Store((*managedRule)(nil))
+	return m
+}
+
+// Update instantiates the given rule and makes it the current rule. The
+// previous rule is closed once the runs and additive contexts using it are
+// done. When the new rule cannot be loaded, the current rule is kept.
+// Concurrent updates are serialized so that the current rule is the last one
+// instantiated. types.ErrRuleClosed is returned once the manager is closed.
+func (m *Manager) Update(rule string) (types.Diagnostics, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, types.ErrRuleClosed
+	}
+
+	r, diags, err := NewRuleWithConfig(rule, m.config)
+	if err != nil {
+		return diags, err
+	}
+	m.generation++
+	old := m.swap(newManagedRule(r, m.generation))
+	if old != nil {
+		old.release()
+	}
+	return diags, nil
+}
+
+func (m *Manager) swap(r *managedRule) (old *managedRule) {
+	old = m.current.Load().(*managedRule)
+	m.current.Store(r)
+	return old
+}
+
+// acquire a reference to the current rule, or nil if there is none. The
+// reference must be released by the caller.
+func (m *Manager) acquire() *managedRule {
+	for {
+		r := m.current.Load().(*managedRule)
+		if r == nil || r.acquire() {
+			return r
+		}
+		// The rule was released in the meantime by an update, so retry with the
+		// new one.
+	}
+}
+
+// Generation returns the number of successful updates of the rule, which is
+// also the generation of the current rule. It is zero when no rule was
+// loaded yet.
+func (m *Manager) Generation() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.generation
+}
+
+// Run the current rule. types.ErrNoRule is returned when there is none.
+func (m *Manager) Run(data types.DataSet, timeout time.Duration) (action types.Action, info []byte, err error) {
+	r := m.acquire()
+	if r == nil {
+		return types.NoAction, nil, types.ErrNoRule
+	}
+	defer r.release()
+	return r.rule.Run(data, timeout)
+}
+
+func (m *Manager) RunWithResult(data types.DataSet, timeout time.Duration) (types.Result, error) {
+	r := m.acquire()
+	if r == nil {
+		return types.Result{}, types.ErrNoRule
+	}
+	defer r.release()
+	// The rules of every engine implement the optional run interfaces
+	return r.rule.(types.ResultRunner).RunWithResult(data, timeout)
+}
+
+func (m *Manager) RunContext(ctx context.Context, data types.DataSet) (action types.Action, info []byte, err error) {
+	r := m.acquire()
+	if r == nil {
+		return types.NoAction, nil, types.ErrNoRule
+	}
+	defer r.release()
+	return r.rule.(types.ContextRunner).RunContext(ctx, data)
+}
+
+// NewAdditiveContext returns a new additive context of the current rule,
+// along with the generation of the rule. The context keeps using the rule
+// until it is closed, even if the rule gets replaced in the meantime.
+func (m *Manager) NewAdditiveContext() (types.Rule, uint64, error) {
+	r := m.acquire()
+	if r == nil {
+		return nil, 0, types.ErrNoRule
+	}
+	defer r.release()
+	ctx, err := NewAdditiveContextWithError(r.rule)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ctx, r.generation, nil
+}
+
+// Close releases the current rule. It is closed once the runs and additive
+// contexts using it are done. The manager can no longer be updated once
+// closed.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	if old := m.swap(nil); old != nil {
+		old.release()
+	}
+	return nil
+}
+
+// Static assertion that the manager implements the rule interfaces
+var (
+	_ types.Rule          = (*Manager)(nil)
+	_ types.ResultRunner  = (*Manager)(nil)
+	_ types.ContextRunner = (*Manager)(nil)
+)
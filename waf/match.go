@@ -0,0 +1,226 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package waf
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// DecodeMatchEvents decodes the match report returned by a WAF run into the
+// list of rule matches it contains. Unknown fields are ignored so that the
+// decoding is tolerant to additions, and the following report formats are
+// supported:
+//   - The flow-based format of libwaf 1.x, where every entry is a flow step
+//     match having a list of rule filter matches.
+//   - The rule-based format of later releases, where every entry is a rule
+//     match having a list of operator matches of parameters.
+//
+// A nil or empty report is decoded into a nil list.
+func DecodeMatchEvents(info []byte) ([]types.MatchEvent, error) {
+	if len(bytes.TrimSpace(info)) == 0 {
+		return nil, nil
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(info, &entries); err != nil {
+		return nil, errors.Wrap(err, "could not decode the match report")
+	}
+
+	var events []types.MatchEvent
+	for i, entry := range entries {
+		var probe struct {
+			Rule json.RawMessage `json:"rule"`
+		}
+		if err := json.Unmarshal(entry, &probe); err != nil {
+			return nil, errors.Wrapf(err, "could not decode the match report entry %d", i)
+		}
+
+		var (
+			matches []types.MatchEvent
+			err     error
+		)
+		if isRuleObject(probe.Rule) {
+			matches, err = decodeRuleMatches(entry)
+		} else {
+			matches, err = decodeFlowMatches(entry)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not decode the match report entry %d", i)
+		}
+		events = append(events, matches...)
+	}
+	return events, nil
+}
+
+// isRuleObject returns true when the rule is a JSON object, which is the case
+// of the rule-based report format.
+func isRuleObject(rule json.RawMessage) bool {
+	rule = bytes.TrimSpace(rule)
+	return len(rule) > 0 && rule[0] == '{'
+}
+
+// Flow-based report entry.
+type flowMatch struct {
+	RetCode int             `json:"ret_code"`
+	Flow    string          `json:"flow"`
+	Step    string          `json:"step"`
+	Rule    string          `json:"rule"`
+	Filter  json.RawMessage `json:"filter"`
+}
+
+type filterMatch struct {
+	Operator        string        `json:"operator"`
+	OperatorValue   interface{}   `json:"operator_value"`
+	BindingAccessor string        `json:"binding_accessor"`
+	ManifestKey     string        `json:"manifest_key"`
+	KeyPath         []interface{} `json:"key_path"`
+	ResolvedValue   interface{}   `json:"resolved_value"`
+	MatchStatus     interface{}   `json:"match_status"`
+}
+
+func decodeFlowMatches(entry json.RawMessage) ([]types.MatchEvent, error) {
+	var m flowMatch
+	if err := json.Unmarshal(entry, &m); err != nil {
+		return nil, err
+	}
+
+	// The filter matches are either a list or a single object
+	var filters []filterMatch
+	if len(m.Filter) > 0 {
+		if err := json.Unmarshal(m.Filter, &filters); err != nil {
+			var filter filterMatch
+			if err := json.Unmarshal(m.Filter, &filter); err != nil {
+				return nil, err
+			}
+			filters = []filterMatch{filter}
+		}
+	}
+
+	event := types.MatchEvent{
+		Action:   goAction(m.RetCode),
+		RuleID:   m.Rule,
+		FlowName: m.Flow,
+		Step:     m.Step,
+	}
+	if len(filters) == 0 {
+		return []types.MatchEvent{event}, nil
+	}
+
+	events := make([]types.MatchEvent, 0, len(filters))
+	for _, f := range filters {
+		event := event
+		event.Operator = f.Operator
+		event.OperatorValue = stringify(f.OperatorValue)
+		event.Address = f.ManifestKey
+		if event.Address == "" {
+			event.Address = f.BindingAccessor
+		}
+		event.KeyPath = keyPath(f.KeyPath)
+		event.ResolvedValue = stringify(f.ResolvedValue)
+		event.MatchedValue = stringify(f.MatchStatus)
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// Rule-based report entry.
+type ruleMatch struct {
+	Rule struct {
+		ID string `json:"id"`
+	} `json:"rule"`
+	RuleMatches []struct {
+		Operator      string      `json:"operator"`
+		OperatorValue interface{} `json:"operator_value"`
+		Parameters    []struct {
+			Address   string        `json:"address"`
+			KeyPath   []interface{} `json:"key_path"`
+			Value     interface{}   `json:"value"`
+			Highlight []interface{} `json:"highlight"`
+		} `json:"parameters"`
+	} `json:"rule_matches"`
+}
+
+func decodeRuleMatches(entry json.RawMessage) ([]types.MatchEvent, error) {
+	var m ruleMatch
+	if err := json.Unmarshal(entry, &m); err != nil {
+		return nil, err
+	}
+
+	var events []types.MatchEvent
+	for _, match := range m.RuleMatches {
+		event := types.MatchEvent{
+			Action:        types.MonitorAction,
+			RuleID:        m.Rule.ID,
+			Operator:      match.Operator,
+			OperatorValue: stringify(match.OperatorValue),
+		}
+		if len(match.Parameters) == 0 {
+			events = append(events, event)
+			continue
+		}
+		for _, p := range match.Parameters {
+			event := event
+			event.Address = p.Address
+			event.KeyPath = keyPath(p.KeyPath)
+			event.ResolvedValue = stringify(p.Value)
+			if len(p.Highlight) > 0 {
+				event.MatchedValue = stringify(p.Highlight[0])
+			} else {
+				event.MatchedValue = event.ResolvedValue
+			}
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		events = []types.MatchEvent{{Action: types.MonitorAction, RuleID: m.Rule.ID}}
+	}
+	return events, nil
+}
+
+func goAction(retCode int) types.Action {
+	switch retCode {
+	case 1:
+		return types.MonitorAction
+	case 2:
+		return types.BlockAction
+	default:
+		return types.NoAction
+	}
+}
+
+// keyPath converts the key path made of map keys and array indexes into a list
+// of strings.
+func keyPath(path []interface{}) []string {
+	if len(path) == 0 {
+		return nil
+	}
+	keys := make([]string, len(path))
+	for i, k := range path {
+		keys[i] = stringify(k)
+	}
+	return keys
+}
+
+// stringify returns the string representation of a decoded JSON value.
+func stringify(v interface{}) string {
+	switch actual := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return actual
+	case float64:
+		return strconv.FormatFloat(actual, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(actual)
+	default:
+		buf, _ := json.Marshal(actual)
+		return string(buf)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package waf_test
+
+import (
+	"testing"
+
+	"github.com/sqreen/go-libsqreen/waf"
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeMatchEvents(t *testing.T) {
+	for _, tc := range []struct {
+		Name          string
+		Info          string
+		ExpectedError bool
+		Expected      []types.MatchEvent
+	}{
+		{
+			Name: "empty report",
+			Info: "",
+		},
+		{
+			Name:          "invalid report",
+			Info:          `{ oops`,
+			ExpectedError: true,
+		},
+		{
+			Name:          "unexpected report type",
+			Info:          `{"flow": "arachni_detection"}`,
+			ExpectedError: true,
+		},
+		{
+			Name: "exit_monitor report",
+			Info: `[{"ret_code":1,"flow":"arachni_detection","step":"start","rule":"1","filter":[{"operator":"@rx","operator_value":"Arachni","binding_accessor":"user-agent","manifest_key":"user-agent","key_path":[],"resolved_value":"Arachni","match_status":"Arachni"}]}]`,
+			Expected: []types.MatchEvent{
+				{
+					Action:        types.MonitorAction,
+					RuleID:        "1",
+					FlowName:      "arachni_detection",
+					Step:          "start",
+					Operator:      "@rx",
+					OperatorValue: "Arachni",
+					Address:       "user-agent",
+					ResolvedValue: "Arachni",
+					MatchedValue:  "Arachni",
+				},
+			},
+		},
+		{
+			Name: "exit_block report with a key path and unknown fields",
+			Info: `[{"ret_code":2,"flow":"arachni_detection","step":"start","rule":"1","new_field":{"a":1},"filter":[{"operator":"@rx","operator_value":"Arachni","binding_accessor":"user-agent","manifest_key":"user-agent","key_path":["agents",3],"resolved_value":"Arachni/v1","match_status":"Arachni","new_field":true}]}]`,
+			Expected: []types.MatchEvent{
+				{
+					Action:        types.BlockAction,
+					RuleID:        "1",
+					FlowName:      "arachni_detection",
+					Step:          "start",
+					Operator:      "@rx",
+					OperatorValue: "Arachni",
+					Address:       "user-agent",
+					KeyPath:       []string{"agents", "3"},
+					ResolvedValue: "Arachni/v1",
+					MatchedValue:  "Arachni",
+				},
+			},
+		},
+		{
+			Name: "single filter object",
+			Info: `[{"ret_code":2,"flow":"f","step":"s","rule":"1","filter":{"operator":"@eq","operator_value":"x","binding_accessor":"server.request.query"}}]`,
+			Expected: []types.MatchEvent{
+				{
+					Action:        types.BlockAction,
+					RuleID:        "1",
+					FlowName:      "f",
+					Step:          "s",
+					Operator:      "@eq",
+					OperatorValue: "x",
+					Address:       "server.request.query",
+				},
+			},
+		},
+		{
+			Name: "rule-based report",
+			Info: `[{"rule":{"id":"crs-913-110","name":"Arachni","tags":{"type":"security_scanner"}},"rule_matches":[{"operator":"match_regex","operator_value":"^Arachni","parameters":[{"address":"server.request.headers.no_cookies","key_path":["user-agent"],"value":"Arachni/v1","highlight":["Arachni"]}]}]}]`,
+			Expected: []types.MatchEvent{
+				{
+					Action:        types.MonitorAction,
+					RuleID:        "crs-913-110",
+					Operator:      "match_regex",
+					OperatorValue: "^Arachni",
+					Address:       "server.request.headers.no_cookies",
+					KeyPath:       []string{"user-agent"},
+					ResolvedValue: "Arachni/v1",
+					MatchedValue:  "Arachni",
+				},
+			},
+		},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			events, err := waf.DecodeMatchEvents([]byte(tc.Info))
+			if tc.ExpectedError {
+				require.Error(t, err)
+				require.Nil(t, events)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.Expected, events)
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package waf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sqreen/go-libsqreen/waf/internal/bindings"
+	"github.com/sqreen/go-libsqreen/waf/types"
+)
+
+// Registry of named WAF rules. Unlike the rules returned by NewRule, their
+// lifetime is managed by the WAF library itself: a rule can be safely replaced
+// or removed at any time, the runs and additive contexts using it keep using
+// it until they are done.
+type Registry struct {
+	registry *bindings.Registry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{registry: bindings.NewRegistry()}
+}
+
+// Load instantiates the rule with the given name and configuration, replacing
+// the previous rule having the same name, if any. When the rule cannot be
+// loaded, the previous one is kept and the returned error is a
+// *types.InvalidRuleError. The registry relies on the native engine, so
+// configurations selecting the Go engine are rejected.
+func (r *Registry) Load(name, rule string, config types.Config) (types.Diagnostics, error) {
+	if config.Engine == types.EngineGo {
+		return nil, fmt.Errorf("waf registry: unsupported engine `%s`", config.Engine)
+	}
+	return r.registry.Load(name, rule, config)
+}
+
+// Remove the rule with the given name.
+func (r *Registry) Remove(name string) {
+	r.registry.Remove(name)
+}
+
+// Clear removes every rule of the registry.
+func (r *Registry) Clear() {
+	r.registry.Clear()
+}
+
+// Names returns the sorted list of the rule names of the registry.
+func (r *Registry) Names() []string {
+	return r.registry.Names()
+}
+
+// Run the rule with the given name. types.ErrNoRule is returned when there is
+// no such rule.
+func (r *Registry) Run(name string, data types.DataSet, timeout time.Duration) (action types.Action, info []byte, err error) {
+	return r.registry.Run(name, data, timeout)
+}
+
+// RunWithResult is similar to Run but returns the run result along with
+// performance data.
+func (r *Registry) RunWithResult(name string, data types.DataSet, timeout time.Duration) (types.Result, error) {
+	return r.registry.RunWithResult(name, data, timeout)
+}
+
+// RunContext is similar to Run but the time budget is the time left until the
+// context deadline, or the default WAF budget when it has no deadline, both
+// including the time spent encoding the data.
+func (r *Registry) RunContext(ctx context.Context, name string, data types.DataSet) (action types.Action, info []byte, err error) {
+	return r.registry.RunContext(ctx, name, data)
+}
+
+// NewAdditiveContext returns a new additive context of the rule with the given
+// name. It keeps using the rule even if it gets replaced or removed.
+func (r *Registry) NewAdditiveContext(name string) (types.Rule, error) {
+	return r.registry.NewAdditiveContext(name)
+}
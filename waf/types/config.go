@@ -0,0 +1,248 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package types
+
+import "fmt"
+
+// Default limits of the values passed to the WAF. They are the same as the
+// native library defaults.
+const (
+	DefaultMaxValueDepth   = 20
+	DefaultMaxStringLength = 4096
+	DefaultMaxArrayLength  = 256
+	DefaultMaxMapLength    = 256
+)
+
+// Upper bounds of the configurable limits.
+const (
+	MaxValueDepthLimit   = 128
+	MaxStringLengthLimit = 64 * 1024 * 1024
+	MaxArrayLengthLimit  = 1024 * 1024
+	MaxMapLengthLimit    = 1024 * 1024
+)
+
+// Config is the configuration of a WAF rule instance. It sets the limits
+// applied both when encoding Go values into WAF values and by the native
+// library when validating them. Zero fields take their default value.
+type Config struct {
+	// MaxValueDepth is the maximum number of nested arrays, maps and structs.
+	// Deeper values are ignored.
+	MaxValueDepth int
+	// MaxStringLength is the maximum length of strings. Longer strings are
+	// truncated.
+	MaxStringLength int
+	// MaxArrayLength is the maximum number of array or slice elements. Extra
+	// elements are ignored.
+	MaxArrayLength int
+	// MaxMapLength is the maximum number of map entries or struct fields. Extra
+	// entries are ignored: the entries of PriorityKeys are kept first, followed
+	// by the map entries in the lexicographical order of their keys, or by the
+	// struct fields in their declaration order, so that the same entries are
+	// always kept.
+	MaxMapLength int
+	// PriorityKeys is the ordered list of map keys and struct field names kept
+	// first when truncating maps and structs to MaxMapLength, such as the WAF
+	// addresses of the data set that must always be encoded.
+	PriorityKeys []string
+	// StrictMapKeys only encodes the map entries having string keys, the other
+	// entries being ignored. Integer and boolean keys are otherwise converted
+	// into strings, as are the keys implementing the text or string marshaler
+	// interfaces of Marshalers.
+	StrictMapKeys bool
+	// Engine is the WAF engine running the rule.
+	Engine Engine
+	// Marshalers is the ordered list of marshaler interfaces values can
+	// implement to be encoded as strings, the first one implemented by a value
+	// being used. It is DefaultMarshalers() when nil, and an empty list
+	// disables them.
+	Marshalers []Marshaler
+	// JSONTagFallback enables using the `json` tag of struct fields having no
+	// `waf` tag. Struct fields are otherwise encoded according to their `waf`
+	// tag only, in the same format as `json` tags: `waf:"name,omitempty"`
+	// renames the field and omits it when empty, and `waf:"-"` always omits
+	// it.
+	JSONTagFallback bool
+	// FloatEncoding is the encoding of floating-point numbers.
+	FloatEncoding FloatEncoding
+	// BytesEncoding is the encoding of byte slices and io.Reader values, which
+	// are encoded as strings. Readers are read up to MaxStringLength bytes.
+	BytesEncoding BytesEncoding
+}
+
+// BytesEncoding is the encoding of byte contents, which may not be valid
+// UTF-8.
+type BytesEncoding int
+
+const (
+	// BytesRaw passes the bytes as-is.
+	BytesRaw BytesEncoding = iota
+	// BytesEscaped escapes the bytes that are not valid UTF-8 as `\xNN`, and
+	// backslashes as `\\` so that escaped bytes cannot be confused with the
+	// same text in the content.
+	BytesEscaped
+)
+
+func (e BytesEncoding) String() string {
+	switch e {
+	case BytesRaw:
+		return "raw"
+	case BytesEscaped:
+		return "escaped"
+	default:
+		return fmt.Sprintf("BytesEncoding(%d)", int(e))
+	}
+}
+
+// FloatEncoding is the encoding of floating-point numbers. Whatever the
+// encoding, NaN and infinities are encoded as the strings `NaN`, `+Inf` and
+// `-Inf`, and big.Int and big.Float values as their decimal string.
+type FloatEncoding int
+
+const (
+	// FloatRounded encodes floats as their nearest integer. Floats out of the
+	// int64 range are encoded as with FloatString.
+	FloatRounded FloatEncoding = iota
+	// FloatString encodes floats as their shortest decimal string
+	// representation, such as `0.1` or `1e+308`.
+	FloatString
+)
+
+func (e FloatEncoding) String() string {
+	switch e {
+	case FloatRounded:
+		return "rounded"
+	case FloatString:
+		return "string"
+	default:
+		return fmt.Sprintf("FloatEncoding(%d)", int(e))
+	}
+}
+
+// Marshaler is a marshaling interface values can implement to be encoded as a
+// string.
+type Marshaler int
+
+const (
+	// MarshalerText is the encoding.TextMarshaler interface.
+	MarshalerText Marshaler = iota
+	// MarshalerJSON is the json.Marshaler interface. JSON strings are encoded
+	// as their unquoted value, and other JSON values as their JSON text. It is
+	// not a default marshaler since the JSON texts of objects and arrays are
+	// not meaningful to the rules.
+	MarshalerJSON
+	// MarshalerString is the fmt.Stringer interface.
+	MarshalerString
+)
+
+func (m Marshaler) String() string {
+	switch m {
+	case MarshalerText:
+		return "text"
+	case MarshalerJSON:
+		return "json"
+	case MarshalerString:
+		return "string"
+	default:
+		return fmt.Sprintf("Marshaler(%d)", int(m))
+	}
+}
+
+// DefaultMarshalers returns the default marshalers priority order. The JSON
+// marshaler is opt-in and must be explicitly listed in Config.Marshalers.
+func DefaultMarshalers() []Marshaler {
+	return []Marshaler{MarshalerText, MarshalerString}
+}
+
+// Engine is the implementation of the WAF running the rules.
+type Engine int
+
+const (
+	// EngineAuto uses the native engine when available, and the Go engine
+	// otherwise.
+	EngineAuto Engine = iota
+	// EngineNative uses the native library through cgo.
+	EngineNative
+	// EngineGo uses the pure-Go engine, which supports a subset of the rule
+	// operators.
+	EngineGo
+)
+
+func (e Engine) String() string {
+	switch e {
+	case EngineAuto:
+		return "auto"
+	case EngineNative:
+		return "native"
+	case EngineGo:
+		return "go"
+	default:
+		return fmt.Sprintf("Engine(%d)", int(e))
+	}
+}
+
+// DefaultConfig returns the configuration having every default value.
+func DefaultConfig() Config {
+	return Config{}.WithDefaults()
+}
+
+// WithDefaults returns a copy of the configuration where zero fields are set
+// to their default value.
+func (c Config) WithDefaults() Config {
+	if c.MaxValueDepth == 0 {
+		c.MaxValueDepth = DefaultMaxValueDepth
+	}
+	if c.MaxStringLength == 0 {
+		c.MaxStringLength = DefaultMaxStringLength
+	}
+	if c.MaxArrayLength == 0 {
+		c.MaxArrayLength = DefaultMaxArrayLength
+	}
+	if c.MaxMapLength == 0 {
+		c.MaxMapLength = DefaultMaxMapLength
+	}
+	if c.Marshalers == nil {
+		c.Marshalers = DefaultMarshalers()
+	}
+	return c
+}
+
+// Validate returns an error when a configuration value is out of range. Zero
+// values are valid as they are replaced by their default value.
+func (c Config) Validate() error {
+	for _, limit := range []struct {
+		name  string
+		value int
+		max   int
+	}{
+		{name: "MaxValueDepth", value: c.MaxValueDepth, max: MaxValueDepthLimit},
+		{name: "MaxStringLength", value: c.MaxStringLength, max: MaxStringLengthLimit},
+		{name: "MaxArrayLength", value: c.MaxArrayLength, max: MaxArrayLengthLimit},
+		{name: "MaxMapLength", value: c.MaxMapLength, max: MaxMapLengthLimit},
+	} {
+		if limit.value < 0 || limit.value > limit.max {
+			return fmt.Errorf("invalid waf config: %s `%d` is out of range [0, %d], 0 selecting the default value", limit.name, limit.value, limit.max)
+		}
+	}
+	if c.Engine < EngineAuto || c.Engine > EngineGo {
+		return fmt.Errorf("invalid waf config: unknown engine `%s`", c.Engine)
+	}
+	if c.FloatEncoding < FloatRounded || c.FloatEncoding > FloatString {
+		return fmt.Errorf("invalid waf config: unknown float encoding `%s`", c.FloatEncoding)
+	}
+	if c.BytesEncoding < BytesRaw || c.BytesEncoding > BytesEscaped {
+		return fmt.Errorf("invalid waf config: unknown bytes encoding `%s`", c.BytesEncoding)
+	}
+	seen := make(map[Marshaler]bool, len(c.Marshalers))
+	for _, m := range c.Marshalers {
+		if m < MarshalerText || m > MarshalerString {
+			return fmt.Errorf("invalid waf config: unknown marshaler `%s`", m)
+		}
+		if seen[m] {
+			return fmt.Errorf("invalid waf config: duplicate marshaler `%s`", m)
+		}
+		seen[m] = true
+	}
+	return nil
+}
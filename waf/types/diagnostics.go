@@ -0,0 +1,116 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DiagnosticCode is the kind of problem the WAF reported while loading a rule.
+// The values mirror the native `PW_DIAG_CODE` enum.
+type DiagnosticCode int
+
+const (
+	// DiagUnknown is used for report entries whose code is missing or not
+	// known by these bindings.
+	DiagUnknown DiagnosticCode = iota - 1
+	DiagParsingJSON
+	DiagParsingRule
+	DiagParsingRuleFilter
+	DiagOperatorValue
+	DiagDuplicateRule
+	DiagParsingFlow
+	DiagParsingFlowStep
+	DiagMeaninglessStep
+	DiagDuplicateFlow
+	DiagDuplicateFlowStep
+	DiagStepHasInvalidRule
+)
+
+func (c DiagnosticCode) String() string {
+	switch c {
+	case DiagParsingJSON:
+		return "json parsing error"
+	case DiagParsingRule:
+		return "rule parsing error"
+	case DiagParsingRuleFilter:
+		return "rule filter parsing error"
+	case DiagOperatorValue:
+		return "invalid operator value"
+	case DiagDuplicateRule:
+		return "duplicate rule"
+	case DiagParsingFlow:
+		return "flow parsing error"
+	case DiagParsingFlowStep:
+		return "flow step parsing error"
+	case DiagMeaninglessStep:
+		return "meaningless flow step"
+	case DiagDuplicateFlow:
+		return "duplicate flow"
+	case DiagDuplicateFlowStep:
+		return "duplicate flow step"
+	case DiagStepHasInvalidRule:
+		return "flow step has an invalid rule"
+	default:
+		return fmt.Sprintf("unknown diagnostic `%d`", c)
+	}
+}
+
+// Diagnostic is an entry of the report the WAF produces while loading a rule.
+// The identifiers of the offending rule, flow and step are set when the WAF
+// provided them.
+type Diagnostic struct {
+	Code     DiagnosticCode
+	Message  string
+	RuleID   string
+	FlowName string
+	StepID   string
+}
+
+func (d Diagnostic) String() string {
+	var str strings.Builder
+	str.WriteString(d.Code.String())
+	if d.RuleID != "" {
+		fmt.Fprintf(&str, " (rule `%s`)", d.RuleID)
+	}
+	if d.FlowName != "" {
+		fmt.Fprintf(&str, " (flow `%s`)", d.FlowName)
+	}
+	if d.StepID != "" {
+		fmt.Fprintf(&str, " (step `%s`)", d.StepID)
+	}
+	if d.Message != "" {
+		str.WriteString(": ")
+		str.WriteString(d.Message)
+	}
+	return str.String()
+}
+
+// Diagnostics is the list of problems the WAF reported while loading a rule.
+// When the rule could be loaded nonetheless, they should be considered as
+// warnings.
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) String() string {
+	entries := make([]string, len(d))
+	for i, e := range d {
+		entries[i] = e.String()
+	}
+	return strings.Join(entries, "; ")
+}
+
+// InvalidRuleError is the error returned when the WAF could not load a rule.
+// It holds the diagnostics the WAF reported, if any.
+type InvalidRuleError struct {
+	Diagnostics Diagnostics
+}
+
+func (e *InvalidRuleError) Error() string {
+	if len(e.Diagnostics) == 0 {
+		return "could not instantiate the waf rule"
+	}
+	return fmt.Sprintf("could not instantiate the waf rule: %s", e.Diagnostics)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package types
+
+import "errors"
+
+// WAFEncodable is implemented by the types deciding themselves how they are
+// encoded into WAF values, instead of being encoded according to their Go
+// type, such as lazily computed or redacted views of their values. It takes
+// precedence over the marshaler interfaces, and is also used through a
+// pointer receiver.
+type WAFEncodable interface {
+	// EncodeWAF builds the WAF value of the value. The value is ignored and
+	// reported as unsupported in the encoding statistics when no value is
+	// built or an error is returned.
+	EncodeWAF(b WAFBuilder) error
+}
+
+// WAFBuilder builds a single WAF value within the encoder limits: strings and
+// map keys are truncated, extra array elements and map entries are ignored,
+// as are containers deeper than the maximum depth. They are reported in the
+// encoding statistics like any other value. Builders must not be used once
+// their value is built, nor once the function building their container has
+// returned.
+type WAFBuilder interface {
+	// String builds a string value.
+	String(s string) error
+	// Int builds a signed number value.
+	Int(n int64) error
+	// Uint builds an unsigned number value.
+	Uint(n uint64) error
+	// Array builds an array value having the elements added by the function.
+	Array(func(a WAFArrayBuilder) error) error
+	// Map builds a map value having the entries added by the function.
+	Map(func(m WAFMapBuilder) error) error
+	// Value builds the value of the Go value as it is encoded in data sets, at
+	// the same depth. Values delegating their value back to a value of their
+	// own type are ignored and reported as cycles in the encoding statistics.
+	Value(v interface{}) error
+}
+
+// WAFArrayBuilder adds elements to an array value.
+type WAFArrayBuilder interface {
+	// Append returns the builder of a new element of the array.
+	Append() WAFBuilder
+}
+
+// WAFMapBuilder adds entries to a map value.
+type WAFMapBuilder interface {
+	// Entry returns the builder of the value of a new map entry having the
+	// given key.
+	Entry(key string) WAFBuilder
+}
+
+// ErrWAFBuilderUsed is returned by the builders used once their value is
+// built, or out of the function building their container.
+var ErrWAFBuilderUsed = errors.New("waf builder already used")
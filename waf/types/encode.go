@@ -0,0 +1,108 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package types
+
+import "fmt"
+
+// MaxEncodeEvents is the maximum number of events kept in EncodeStats.
+const MaxEncodeEvents = 32
+
+// MaxRepeatedRefs is the maximum number of times the pointers, maps and slices
+// already encoded elsewhere in a data set are encoded again. Shared
+// sub-structures are otherwise encoded on every path leading to them, which
+// is exponential in their nesting depth.
+const MaxRepeatedRefs = 1024
+
+// EncodeStats summarizes the values of a data set the encoder could not fully
+// encode because of the configuration limits or their type. Their content, or
+// part of it, was therefore not inspected by the WAF.
+type EncodeStats struct {
+	// TruncatedStrings is the number of strings and map keys truncated to
+	// MaxStringLength.
+	TruncatedStrings int
+	// DroppedArrayEntries is the number of array elements ignored beyond
+	// MaxArrayLength.
+	DroppedArrayEntries int
+	// DroppedMapEntries is the number of map entries and struct fields ignored
+	// beyond MaxMapLength.
+	DroppedMapEntries int
+	// DepthCutoffs is the number of values ignored beyond MaxValueDepth.
+	DepthCutoffs int
+	// UnsupportedValues is the number of values ignored because of their type,
+	// such as nil values, functions or channels.
+	UnsupportedValues int
+	// Cycles is the number of pointers, maps and slices ignored because they
+	// reference one of the values containing them, and of WAFEncodable values
+	// ignored because they delegate their value back to their own type.
+	Cycles int
+	// RepeatedRefs is the number of pointers, maps and slices ignored because
+	// they were already encoded elsewhere in the data set and MaxRepeatedRefs
+	// was reached.
+	RepeatedRefs int
+	// Events are the first MaxEncodeEvents events, in the order they occurred,
+	// along with the key path of the value involved.
+	Events []EncodeEvent
+}
+
+// Complete returns true when every value was fully encoded.
+func (s EncodeStats) Complete() bool {
+	return s.TruncatedStrings == 0 && s.DroppedArrayEntries == 0 && s.DroppedMapEntries == 0 &&
+		s.DepthCutoffs == 0 && s.UnsupportedValues == 0 && s.Cycles == 0 &&
+		s.RepeatedRefs == 0
+}
+
+// EncodeEvent is a value that was not fully encoded.
+type EncodeEvent struct {
+	Issue EncodeIssue
+	// KeyPath is the path of map keys and array indexes leading to the value,
+	// starting with its data set address.
+	KeyPath []string
+}
+
+// EncodeIssue is the reason why a value was not fully encoded.
+type EncodeIssue int
+
+const (
+	// EncodeTruncatedString is a string or map key truncated to
+	// MaxStringLength.
+	EncodeTruncatedString EncodeIssue = iota
+	// EncodeDroppedArrayEntries is an array having elements ignored beyond
+	// MaxArrayLength.
+	EncodeDroppedArrayEntries
+	// EncodeDroppedMapEntries is a map or struct having entries ignored beyond
+	// MaxMapLength.
+	EncodeDroppedMapEntries
+	// EncodeDepthCutoff is a value ignored beyond MaxValueDepth.
+	EncodeDepthCutoff
+	// EncodeUnsupportedValue is a value ignored because of its type.
+	EncodeUnsupportedValue
+	// EncodeCycle is a value ignored because it references one of the values
+	// containing it.
+	EncodeCycle
+	// EncodeRepeatedRef is a value ignored because it was already encoded
+	// elsewhere in the data set and MaxRepeatedRefs was reached.
+	EncodeRepeatedRef
+)
+
+func (i EncodeIssue) String() string {
+	switch i {
+	case EncodeTruncatedString:
+		return "truncated string"
+	case EncodeDroppedArrayEntries:
+		return "dropped array entries"
+	case EncodeDroppedMapEntries:
+		return "dropped map entries"
+	case EncodeDepthCutoff:
+		return "depth cutoff"
+	case EncodeUnsupportedValue:
+		return "unsupported value"
+	case EncodeCycle:
+		return "cycle"
+	case EncodeRepeatedRef:
+		return "repeated reference"
+	default:
+		return fmt.Sprintf("EncodeIssue(%d)", int(i))
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+// LeakTrackingConfig is the configuration of the leak tracking debug mode,
+// which tracks the rules and additive contexts until they are closed.
+type LeakTrackingConfig struct {
+	// OnLeak is called with the objects garbage collected without being
+	// closed. It is called from the finalizer goroutine and must therefore
+	// return quickly.
+	OnLeak func(LiveObject)
+	// Release closes the leaked objects so that their native memory, and the
+	// rules they reference, are released.
+	Release bool
+}
+
+// LiveObject is a rule or additive context not closed yet, as tracked by the
+// leak tracking debug mode.
+type LiveObject struct {
+	// ID is the unique identifier of the object, increasing in the creation
+	// order.
+	ID uint64
+	// Kind is the kind of object.
+	Kind ObjectKind
+	// Engine is the engine of the object.
+	Engine Engine
+	// Created is the creation time of the object.
+	Created time.Time
+	// Stack is the stack trace of the creation of the object.
+	Stack string
+}
+
+// ObjectKind is the kind of a tracked object.
+type ObjectKind int
+
+const (
+	// ObjectRule is a rule.
+	ObjectRule ObjectKind = iota
+	// ObjectAdditiveContext is an additive context.
+	ObjectAdditiveContext
+)
+
+func (k ObjectKind) String() string {
+	switch k {
+	case ObjectRule:
+		return "rule"
+	case ObjectAdditiveContext:
+		return "additive context"
+	default:
+		return fmt.Sprintf("ObjectKind(%d)", int(k))
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package types
+
+import "fmt"
+
+// LogLevel is the level of the messages logged by the WAF. The values mirror
+// the native `PW_LOG_LEVEL` enum.
+type LogLevel int
+
+const (
+	LogTrace LogLevel = iota
+	LogDebug
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogTrace:
+		return "trace"
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	default:
+		return fmt.Sprintf("unknown log level `%d`", l)
+	}
+}
+
+// Logger is the interface of the logger receiving the messages logged by the
+// WAF. The function, file and line are the location in the native library
+// where the message was emitted.
+type Logger interface {
+	Log(level LogLevel, function, file string, line int, message string)
+}
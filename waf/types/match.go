@@ -0,0 +1,30 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+package types
+
+// MatchEvent is a match of a WAF rule, as decoded from the JSON match report
+// returned by a run. Fields the report format does not provide are left to
+// their zero value.
+type MatchEvent struct {
+	// Action is the action of the flow step that matched.
+	Action Action
+	// RuleID is the identifier of the rule that matched.
+	RuleID string
+	// FlowName and Step are the flow and flow step the rule belongs to.
+	FlowName string
+	Step     string
+	// Operator is the rule operator (eg. `@rx`) and OperatorValue its
+	// parameter (eg. the regular expression).
+	Operator      string
+	OperatorValue string
+	// Address is the address of the data set the matching value was resolved
+	// from, and KeyPath the path of keys and indexes to the value in it.
+	Address string
+	KeyPath []string
+	// ResolvedValue is the value the operator ran on, and MatchedValue the
+	// part of it that matched.
+	ResolvedValue string
+	MatchedValue  string
+}
@@ -5,6 +5,7 @@
 package types
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"time"
@@ -15,6 +16,27 @@ type Rule interface {
 	io.Closer
 }
 
+// ResultRunner is implemented by the rules and additive contexts of every
+// engine, in addition to Rule. It is a separate interface so that adding it
+// did not break the other implementations of Rule, so type-assert rules to
+// use it.
+type ResultRunner interface {
+	// RunWithResult is similar to Run but returns the run result along with
+	// performance data. The returned result also holds the performance data
+	// known at the time an error occurred.
+	RunWithResult(data DataSet, timeout time.Duration) (Result, error)
+}
+
+// ContextRunner is implemented by the rules and additive contexts of every
+// engine, in addition to Rule. As ResultRunner, type-assert rules to use it.
+type ContextRunner interface {
+	// RunContext is similar to Run but the time budget is the time left until
+	// the context deadline, or the default WAF budget when it has no deadline,
+	// both including the time spent encoding the data. The context error is
+	// returned when it is done before the WAF could run.
+	RunContext(ctx context.Context, data DataSet) (action Action, info []byte, err error)
+}
+
 // DataSet is a map type to associate binding accessor expressions to their results.
 type DataSet map[string]interface{}
 
@@ -26,6 +48,30 @@ const (
 	BlockAction
 )
 
+// Result is the result of a WAF run along with its performance data.
+type Result struct {
+	// Action is the action to perform, and Data the JSON report of the match
+	// when the action is not NoAction.
+	Action Action
+	Data   []byte
+
+	// TotalRuntime is the time spent in the native WAF.
+	TotalRuntime time.Duration
+	// CacheHitRate is the cache hit rate reported by the native WAF.
+	CacheHitRate uint32
+	// PerfData is the decoded JSON performance report of the native WAF, if
+	// any.
+	PerfData map[string]interface{}
+
+	// EncodingTime is the time spent encoding the Go values into WAF values.
+	EncodingTime time.Duration
+	// EncodedValues is the number of WAF values encoded.
+	EncodedValues int
+	// EncodeStats summarizes the values that were not fully encoded, and
+	// therefore not fully inspected by the WAF.
+	EncodeStats EncodeStats
+}
+
 type RunError int
 
 const (
@@ -36,6 +82,15 @@ const (
 	ErrInvalidFlow
 	ErrNoRule
 	ErrOutOfMemory
+	// ErrRuleClosed is returned when running a rule, or updating a Manager,
+	// once closed.
+	ErrRuleClosed
+	// ErrContextClosed is returned when running an additive context once
+	// closed.
+	ErrContextClosed
+	// ErrIncompatibleRule is returned when creating an additive context from a
+	// value which is not a rule of a WAF engine.
+	ErrIncompatibleRule
 )
 
 func (e RunError) Error() string {
@@ -54,6 +109,12 @@ func (e RunError) Error() string {
 		return "no rule"
 	case ErrOutOfMemory:
 		return "out of memory"
+	case ErrRuleClosed:
+		return "rule closed"
+	case ErrContextClosed:
+		return "additive context closed"
+	case ErrIncompatibleRule:
+		return "incompatible rule"
 	default:
 		return fmt.Sprintf("unknown error `%d`", e)
 	}
@@ -72,11 +133,18 @@ var (
 	_ error = ErrInvalidFlow
 	_ error = ErrNoRule
 	_ error = ErrOutOfMemory
+	_ error = ErrRuleClosed
+	_ error = ErrContextClosed
+	_ error = ErrIncompatibleRule
 )
 
 type (
-	NewRuleFunc            = func(string) (Rule, error)
-	NewAdditiveContextFunc = func(Rule) Rule
-	VersionFunc            = func() *string
-	HealthFunc             = func() error
+	NewRuleFunc                     = func(string) (Rule, error)
+	NewRuleWithDiagnosticsFunc      = func(string) (Rule, Diagnostics, error)
+	NewRuleWithConfigFunc           = func(string, Config) (Rule, Diagnostics, error)
+	NewAdditiveContextFunc          = func(Rule) Rule
+	NewAdditiveContextWithErrorFunc = func(Rule) (Rule, error)
+	VersionFunc                     = func() *string
+	HealthFunc                      = func() error
+	SetLoggerFunc                   = func(Logger, LogLevel) error
 )
@@ -10,7 +10,36 @@ func NewRule(rule string) (types.Rule, error) {
 	return newRule(rule)
 }
 
+// NewRuleWithDiagnostics instantiates a WAF rule and returns the diagnostics
+// reported while loading it. They are warnings when the rule could be loaded.
+// Otherwise, the returned error is a *types.InvalidRuleError.
+func NewRuleWithDiagnostics(rule string) (types.Rule, types.Diagnostics, error) {
+	return newRuleWithDiagnostics(rule)
+}
+
+// NewRuleWithConfig instantiates a WAF rule having the limits of the given
+// configuration, and returns the diagnostics reported while loading it. An
+// error is returned when the configuration is invalid.
+func NewRuleWithConfig(rule string, config types.Config) (types.Rule, types.Diagnostics, error) {
+	return newRuleWithConfig(rule, config)
+}
+
+// NewAdditiveContext returns a new additive context of the rule, or nil when
+// it cannot be created. See NewAdditiveContextWithError.
 func NewAdditiveContext(r types.Rule) types.Rule {
+	ctx, _ := newAdditiveContext(r)
+	if ctx == nil {
+		return nil
+	}
+	return ctx
+}
+
+// NewAdditiveContextWithError returns a new additive context of the rule,
+// which must be closed once no longer used. The returned error tells why it
+// could not be created: types.ErrIncompatibleRule when the rule was not
+// returned by this package, types.ErrRuleClosed when it was closed, or another
+// error reported by the rule engine.
+func NewAdditiveContextWithError(r types.Rule) (types.Rule, error) {
 	return newAdditiveContext(r)
 }
 
@@ -22,10 +51,28 @@ func Health() error {
 	return health()
 }
 
+// SetLogger sets the logger receiving the WAF messages of at least the given
+// level, or disables the logging when nil. It can be called at any time to
+// replace the logger. The logger is called from its own goroutine and messages
+// are dropped when it cannot keep up with them.
+func SetLogger(logger types.Logger, minLevel types.LogLevel) error {
+	return setLogger(logger, minLevel)
+}
+
+// DroppedLogs returns the number of WAF log messages dropped because the logger
+// was too slow.
+func DroppedLogs() uint64 {
+	return droppedLogs()
+}
+
 // Static assert that the function have the expected signatures
 var (
-	_ types.NewRuleFunc            = NewRule
-	_ types.NewAdditiveContextFunc = NewAdditiveContext
-	_ types.VersionFunc            = Version
-	_ types.HealthFunc             = Health
+	_ types.NewRuleFunc                     = NewRule
+	_ types.NewRuleWithDiagnosticsFunc      = NewRuleWithDiagnostics
+	_ types.NewRuleWithConfigFunc           = NewRuleWithConfig
+	_ types.NewAdditiveContextFunc          = NewAdditiveContext
+	_ types.NewAdditiveContextWithErrorFunc = NewAdditiveContextWithError
+	_ types.VersionFunc                     = Version
+	_ types.HealthFunc                      = Health
+	_ types.SetLoggerFunc                   = SetLogger
 )
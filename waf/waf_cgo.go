@@ -6,15 +6,44 @@ package waf
 
 import (
 	"github.com/sqreen/go-libsqreen/waf/internal/bindings"
+	"github.com/sqreen/go-libsqreen/waf/internal/goengine"
 	"github.com/sqreen/go-libsqreen/waf/types"
 )
 
 func newRule(rule string) (types.Rule, error) {
-	return bindings.NewRule(rule)
+	r, _, err := newRuleWithConfig(rule, types.DefaultConfig())
+	return r, err
 }
 
-func newAdditiveContext(r types.Rule) types.Rule {
-	return bindings.NewAdditiveContext(r)
+func newRuleWithDiagnostics(rule string) (types.Rule, types.Diagnostics, error) {
+	return newRuleWithConfig(rule, types.DefaultConfig())
+}
+
+func newRuleWithConfig(rule string, config types.Config) (types.Rule, types.Diagnostics, error) {
+	switch config.Engine {
+	case types.EngineNative:
+		return bindings.NewRuleWithConfig(rule, config)
+	case types.EngineGo:
+		return goengine.NewRule(rule, config)
+	default:
+		// Fallback to the Go engine when the native library is not available,
+		// such as in builds without cgo or on unsupported targets.
+		if bindings.Health() != nil {
+			return goengine.NewRule(rule, config)
+		}
+		return bindings.NewRuleWithConfig(rule, config)
+	}
+}
+
+func newAdditiveContext(r types.Rule) (types.Rule, error) {
+	switch r.(type) {
+	case *goengine.Rule:
+		return goengine.NewAdditiveContextWithError(r)
+	case *bindings.Rule:
+		return bindings.NewAdditiveContextWithError(r)
+	default:
+		return nil, types.ErrIncompatibleRule
+	}
 }
 
 func version() *string {
@@ -24,3 +53,11 @@ func version() *string {
 func health() error {
 	return bindings.Health()
 }
+
+func setLogger(logger types.Logger, minLevel types.LogLevel) error {
+	return bindings.SetLogger(logger, minLevel)
+}
+
+func droppedLogs() uint64 {
+	return bindings.DroppedLogs()
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2016 - 2020 Sqreen. All Rights Reserved.
+// Please refer to our terms for more information:
+// https://www.sqreen.io/terms.html
+
+// +build cgo
+// +build amd64
+// +build !windows
+
+package waf_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sqreen/go-libsqreen/waf"
+	"github.com/sqreen/go-libsqreen/waf/types"
+	"github.com/stretchr/testify/require"
+)
+
+// Engines the usage scenarios are run against.
+var testEngines = []types.Engine{types.EngineNative, types.EngineGo}
+
+// TestNative tests the features only available with the native library.
+func TestNative(t *testing.T) {
+	t.Parallel()
+	t.Run("version", func(t *testing.T) {
+		t.Parallel()
+		v := waf.Version()
+		require.NotNil(t, v)
+		require.Equal(t, "1.0.6", *v)
+		require.NoError(t, waf.Health())
+	})
+
+	t.Run("logger", func(t *testing.T) {
+		t.Parallel()
+		require.Error(t, waf.SetLogger(testLogger{}, types.LogLevel(-1)))
+		require.NoError(t, waf.SetLogger(testLogger{}, types.LogTrace))
+		// Replacing it
+		require.NoError(t, waf.SetLogger(testLogger{}, types.LogError))
+
+		r, err := waf.NewRule(`{ oops`)
+		require.Error(t, err)
+		require.Nil(t, r)
+
+		// Disabling it
+		require.NoError(t, waf.SetLogger(nil, types.LogTrace))
+	})
+
+	t.Run("registry", func(t *testing.T) {
+		t.Parallel()
+		registry := waf.NewRegistry()
+		defer registry.Clear()
+
+		// Unknown rule
+		_, _, err := registry.Run("arachni", types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.Equal(t, types.ErrNoRule, err)
+		wafCtx, err := registry.NewAdditiveContext("arachni")
+		require.Equal(t, types.ErrNoRule, err)
+		require.Nil(t, wafCtx)
+
+		_, err = registry.Load("arachni", newTestRule("exit_monitor"), types.Config{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"arachni"}, registry.Names())
+		action, match, err := registry.Run("arachni", types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.MonitorAction, action)
+		requireArachniMatch(t, types.MonitorAction, match)
+
+		wafCtx, err = registry.NewAdditiveContext("arachni")
+		require.NoError(t, err)
+		defer wafCtx.Close()
+
+		// Replace it
+		_, err = registry.Load("arachni", newTestRule("exit_block"), types.Config{})
+		require.NoError(t, err)
+		action, _, err = registry.Run("arachni", types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+
+		// Invalid rules keep the previous one
+		_, err = registry.Load("arachni", `{ oops`, types.Config{})
+		require.IsType(t, &types.InvalidRuleError{}, err)
+		action, _, err = registry.Run("arachni", types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+
+		// Remove it
+		registry.Remove("arachni")
+		require.Empty(t, registry.Names())
+		_, _, err = registry.Run("arachni", types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.Equal(t, types.ErrNoRule, err)
+
+		// The additive context still uses the first rule
+		action, match, err = wafCtx.Run(types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.MonitorAction, action)
+		requireArachniMatch(t, types.MonitorAction, match)
+	})
+
+	t.Run("default engine", func(t *testing.T) {
+		t.Parallel()
+		r, err := waf.NewRule(newTestRule("exit_block"))
+		require.NoError(t, err)
+		defer r.Close()
+		wafCtx := waf.NewAdditiveContext(r)
+		require.NotNil(t, wafCtx)
+		require.NoError(t, wafCtx.Close())
+	})
+}
+
+type testLogger struct{}
+
+func (testLogger) Log(types.LogLevel, string, string, int, string) {}
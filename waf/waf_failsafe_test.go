@@ -8,14 +8,35 @@ package waf_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/sqreen/go-libsqreen/waf"
+	"github.com/sqreen/go-libsqreen/waf/types"
 	"github.com/stretchr/testify/require"
 )
 
-func TestUsage(t *testing.T) {
+// Engines the usage scenarios are run against.
+var testEngines = []types.Engine{types.EngineGo}
+
+// TestDisabled tests the behaviour of the API when the native library is not
+// available.
+func TestDisabled(t *testing.T) {
 	t.Run("rule", func(t *testing.T) {
-		r, err := waf.NewRule("")
+		// The Go engine is used by default
+		r, err := waf.NewRule(newTestRule("exit_block"))
+		require.NoError(t, err)
+		wafCtx := waf.NewAdditiveContext(r)
+		require.NotNil(t, wafCtx)
+		require.NoError(t, wafCtx.Close())
+		require.NoError(t, r.Close())
+
+		r, diags, err := waf.NewRuleWithDiagnostics("")
+		require.Nil(t, r)
+		require.NotEmpty(t, diags)
+		require.IsType(t, &types.InvalidRuleError{}, err)
+
+		// The native engine is not available
+		r, _, err = waf.NewRuleWithConfig(newTestRule("exit_block"), types.Config{Engine: types.EngineNative})
 		require.Nil(t, r)
 		require.Error(t, err)
 	})
@@ -27,4 +48,38 @@ func TestUsage(t *testing.T) {
 	t.Run("health", func(t *testing.T) {
 		require.Error(t, waf.Health())
 	})
+
+	t.Run("registry", func(t *testing.T) {
+		registry := waf.NewRegistry()
+		_, err := registry.Load("rule", "", types.Config{})
+		require.Error(t, err)
+		require.Empty(t, registry.Names())
+	})
+
+	t.Run("manager", func(t *testing.T) {
+		m := waf.NewManager(types.Config{})
+		_, err := m.Update("")
+		require.Error(t, err)
+		require.Zero(t, m.Generation())
+		_, _, err = m.Run(types.DataSet{}, time.Second)
+		require.Equal(t, types.ErrNoRule, err)
+		require.NoError(t, m.Close())
+	})
+
+	t.Run("file loader", func(t *testing.T) {
+		var errors []*waf.LoadError
+		loader := waf.NewFileLoader("waf_failsafe_test.go", types.Config{}, time.Hour, func(types.Rule, types.Diagnostics) {
+			t.Fatal("unexpected rule load")
+		}, func(err *waf.LoadError) {
+			errors = append(errors, err)
+		})
+		require.False(t, loader.Poll())
+		require.Len(t, errors, 1)
+		require.Error(t, errors[0].Err)
+	})
+
+	t.Run("logger", func(t *testing.T) {
+		require.Error(t, waf.SetLogger(nil, types.LogTrace))
+		require.Zero(t, waf.DroppedLogs())
+	})
 }
@@ -2,13 +2,16 @@
 // Please refer to our terms for more information:
 // https://www.sqreen.io/terms.html
 
-// +build cgo
-// +build amd64
-// +build !windows
-
 package waf_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
@@ -20,20 +23,114 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// testRule is a rule or additive context implementing the optional run
+// interfaces, as those of every engine do.
+type testRule interface {
+	types.Rule
+	types.ResultRunner
+	types.ContextRunner
+}
+
+func newTestRuleWithConfig(rule string, config types.Config) (testRule, types.Diagnostics, error) {
+	r, diags, err := waf.NewRuleWithConfig(rule, config)
+	if r == nil {
+		return nil, diags, err
+	}
+	return r.(testRule), diags, err
+}
+
 func TestUsage(t *testing.T) {
 	t.Parallel()
-	t.Run("version", func(t *testing.T) {
-		t.Parallel()
-		v := waf.Version()
-		require.NotNil(t, v)
-		require.Equal(t, "1.0.6", *v)
-		require.NoError(t, waf.Health())
+	for _, engine := range testEngines {
+		engine := engine
+		t.Run(engine.String(), func(t *testing.T) {
+			t.Parallel()
+			testUsage(t, types.Config{Engine: engine})
+		})
+	}
+}
+
+func TestRegistryEngine(t *testing.T) {
+	t.Parallel()
+	registry := waf.NewRegistry()
+	defer registry.Clear()
+
+	// The registry relies on the native engine
+	_, err := registry.Load("arachni", newTestRule("exit_block"), types.Config{Engine: types.EngineGo})
+	require.EqualError(t, err, "waf registry: unsupported engine `go`")
+	require.Empty(t, registry.Names())
+	_, _, err = registry.Run("arachni", types.DataSet{"user-agent": "Arachni"}, time.Second)
+	require.Error(t, err)
+}
+
+func TestLeakTracking(t *testing.T) {
+	// Not parallel as the leak tracking is global
+	leaked := make(chan types.LiveObject, 10)
+	waf.EnableLeakTracking(types.LeakTrackingConfig{
+		OnLeak:  func(o types.LiveObject) { leaked <- o },
+		Release: true,
 	})
+	defer waf.DisableLeakTracking()
+
+	for _, engine := range testEngines {
+		engine := engine
+		t.Run(engine.String(), func(t *testing.T) {
+			config := types.Config{Engine: engine}
+			r, _, err := waf.NewRuleWithConfig(newTestRule("exit_block"), config)
+			require.NoError(t, err)
+			ctx, err := waf.NewAdditiveContextWithError(r)
+			require.NoError(t, err)
+
+			objects := waf.LiveObjects()
+			require.Len(t, objects, 2)
+			require.Equal(t, types.ObjectRule, objects[0].Kind)
+			require.Equal(t, types.ObjectAdditiveContext, objects[1].Kind)
+			for _, o := range objects {
+				require.Equal(t, engine, o.Engine)
+				require.Contains(t, o.Stack, "waf_test.TestLeakTracking")
+			}
+
+			require.NoError(t, ctx.Close())
+			require.NoError(t, r.Close())
+			require.Empty(t, waf.LiveObjects())
+
+			// Objects garbage collected without being closed are reported and
+			// released
+			func() {
+				r, _, err := waf.NewRuleWithConfig(newTestRule("exit_block"), config)
+				require.NoError(t, err)
+				_, err = waf.NewAdditiveContextWithError(r)
+				require.NoError(t, err)
+			}()
+			var kinds []types.ObjectKind
+			deadline := time.Now().Add(10 * time.Second)
+			for len(kinds) < 2 && time.Now().Before(deadline) {
+				runtime.GC()
+				select {
+				case o := <-leaked:
+					kinds = append(kinds, o.Kind)
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			// The context references the rule, which is therefore collected after
+			require.Equal(t, []types.ObjectKind{types.ObjectAdditiveContext, types.ObjectRule}, kinds)
+			require.Empty(t, waf.LiveObjects())
+		})
+	}
+}
+
+// testUsage runs the usage scenarios with rules instantiated with the given
+// configuration.
+func testUsage(t *testing.T, config types.Config) {
+	newRule := func(rule string) (testRule, error) {
+		r, _, err := newTestRuleWithConfig(rule, config)
+		return r, err
+	}
 
 	t.Run("monitor", func(t *testing.T) {
 		t.Parallel()
 		rule := newTestRule("exit_monitor")
-		r, err := waf.NewRule(rule)
+		r, err := newRule(rule)
 		require.NoError(t, err)
 		defer r.Close()
 
@@ -42,6 +139,7 @@ func TestUsage(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, types.MonitorAction, action)
 		require.NotEmpty(t, match)
+		requireArachniMatch(t, types.MonitorAction, match)
 
 		// Non matching input
 		action, match, err = r.Run(types.DataSet{"user-agent": "go client"}, time.Second)
@@ -59,7 +157,7 @@ func TestUsage(t *testing.T) {
 	t.Run("block", func(t *testing.T) {
 		t.Parallel()
 		rule := newTestRule("exit_block")
-		r, err := waf.NewRule(rule)
+		r, err := newRule(rule)
 		require.NoError(t, err)
 		defer r.Close()
 
@@ -68,6 +166,7 @@ func TestUsage(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, types.BlockAction, action)
 		require.NotEmpty(t, match)
+		requireArachniMatch(t, types.BlockAction, match)
 
 		// Non matching input
 		action, match, err = r.Run(types.DataSet{"user-agent": "go client"}, time.Second)
@@ -82,10 +181,373 @@ func TestUsage(t *testing.T) {
 		require.Empty(t, match)
 	})
 
+	t.Run("diagnostics", func(t *testing.T) {
+		t.Parallel()
+		r, diags, err := waf.NewRuleWithConfig(newTestRule("exit_block"), config)
+		require.NoError(t, err)
+		require.Empty(t, diags)
+		require.NoError(t, r.Close())
+
+		r, diags, err = waf.NewRuleWithConfig(`{ oops`, config)
+		require.Error(t, err)
+		require.Nil(t, r)
+		require.IsType(t, &types.InvalidRuleError{}, err)
+		require.Equal(t, diags, err.(*types.InvalidRuleError).Diagnostics)
+	})
+
+	t.Run("config", func(t *testing.T) {
+		t.Parallel()
+		r, _, err := waf.NewRuleWithConfig(newTestRule("exit_block"), types.Config{
+			MaxArrayLength: 1024,
+			MaxMapLength:   1024,
+			Engine:         config.Engine,
+		})
+		require.NoError(t, err)
+		defer r.Close()
+
+		// The matching value is beyond the default array length limit
+		userAgents := make([]string, 1000)
+		userAgents[999] = "Arachni"
+		action, match, err := r.Run(types.DataSet{"user-agent": userAgents}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+		require.NotEmpty(t, match)
+
+		r, _, err = waf.NewRuleWithConfig(newTestRule("exit_block"), types.Config{MaxValueDepth: -1, Engine: config.Engine})
+		require.EqualError(t, err, "invalid waf config: MaxValueDepth `-1` is out of range [0, 128], 0 selecting the default value")
+		require.Nil(t, r)
+	})
+
+	t.Run("result", func(t *testing.T) {
+		t.Parallel()
+		r, err := newRule(newTestRule("exit_block"))
+		require.NoError(t, err)
+		defer r.Close()
+
+		res, err := r.RunWithResult(types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, res.Action)
+		require.NotEmpty(t, res.Data)
+		require.Equal(t, 2, res.EncodedValues)
+		require.NotZero(t, res.EncodingTime)
+
+		ctx := waf.NewAdditiveContext(r).(testRule)
+		require.NotNil(t, ctx)
+		defer ctx.Close()
+		res, err = ctx.RunWithResult(types.DataSet{"user-agent": "go client"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.NoAction, res.Action)
+		require.Empty(t, res.Data)
+		require.Equal(t, 2, res.EncodedValues)
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		t.Parallel()
+		r, err := newRule(newTestRule("exit_block"))
+		require.NoError(t, err)
+		defer r.Close()
+
+		for _, userAgent := range []interface{}{
+			[]byte("Arachni"),
+			json.RawMessage(`"Arachni"`),
+			strings.NewReader("Arachni"),
+		} {
+			action, match, err := r.Run(types.DataSet{"user-agent": userAgent}, time.Second)
+			require.NoError(t, err)
+			require.Equal(t, types.BlockAction, action)
+			require.NotEmpty(t, match)
+		}
+	})
+
+	t.Run("encode stats", func(t *testing.T) {
+		t.Parallel()
+		r, _, err := newTestRuleWithConfig(newTestRule("exit_block"), types.Config{
+			MaxStringLength: 10,
+			MaxArrayLength:  2,
+			Engine:          config.Engine,
+		})
+		require.NoError(t, err)
+		defer r.Close()
+
+		// The payload is hidden beyond the limits
+		res, err := r.RunWithResult(types.DataSet{
+			"user-agent": []interface{}{"go http client", nil, "curl", "Arachni"},
+		}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.NoAction, res.Action)
+		require.False(t, res.EncodeStats.Complete())
+		require.Equal(t, types.EncodeStats{
+			TruncatedStrings:    1,
+			DroppedArrayEntries: 1,
+			UnsupportedValues:   1,
+			Events: []types.EncodeEvent{
+				{Issue: types.EncodeTruncatedString, KeyPath: []string{"user-agent", "0"}},
+				{Issue: types.EncodeUnsupportedValue, KeyPath: []string{"user-agent", "1"}},
+				{Issue: types.EncodeDroppedArrayEntries, KeyPath: []string{"user-agent"}},
+			},
+		}, res.EncodeStats)
+
+		res, err = r.RunWithResult(types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, res.Action)
+		require.True(t, res.EncodeStats.Complete())
+		require.Empty(t, res.EncodeStats.Events)
+	})
+
+	t.Run("truncated maps", func(t *testing.T) {
+		t.Parallel()
+		data := types.DataSet{
+			"a":          "go client",
+			"b":          "curl",
+			"user-agent": "Arachni",
+		}
+
+		// The first keys in lexicographical order are kept
+		r, _, err := newTestRuleWithConfig(newTestRule("exit_block"), types.Config{
+			MaxMapLength: 2,
+			Engine:       config.Engine,
+		})
+		require.NoError(t, err)
+		defer r.Close()
+		for i := 0; i < 10; i++ {
+			res, err := r.RunWithResult(data, time.Second)
+			require.NoError(t, err)
+			require.Equal(t, types.NoAction, res.Action)
+			require.Equal(t, 1, res.EncodeStats.DroppedMapEntries)
+		}
+
+		// The priority keys are kept first
+		r, _, err = newTestRuleWithConfig(newTestRule("exit_block"), types.Config{
+			MaxMapLength: 2,
+			PriorityKeys: []string{"user-agent"},
+			Engine:       config.Engine,
+		})
+		require.NoError(t, err)
+		defer r.Close()
+		for i := 0; i < 10; i++ {
+			res, err := r.RunWithResult(data, time.Second)
+			require.NoError(t, err)
+			require.Equal(t, types.BlockAction, res.Action)
+			require.Equal(t, 1, res.EncodeStats.DroppedMapEntries)
+		}
+	})
+
+	t.Run("map keys", func(t *testing.T) {
+		t.Parallel()
+		data := types.DataSet{
+			"user-agent": map[interface{}]string{1: "Arachni", true: "curl", 1.5: "go client"},
+		}
+
+		// Non-string keys are converted
+		r, err := newRule(newTestRule("exit_block"))
+		require.NoError(t, err)
+		defer r.Close()
+		res, err := r.RunWithResult(data, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, res.Action)
+		require.Equal(t, 1, res.EncodeStats.UnsupportedValues)
+
+		// Only string keys are kept
+		r, _, err = newTestRuleWithConfig(newTestRule("exit_block"), types.Config{
+			StrictMapKeys: true,
+			Engine:        config.Engine,
+		})
+		require.NoError(t, err)
+		defer r.Close()
+		res, err = r.RunWithResult(data, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.NoAction, res.Action)
+		require.Equal(t, 3, res.EncodeStats.UnsupportedValues)
+	})
+
+	t.Run("cycles", func(t *testing.T) {
+		t.Parallel()
+		r, err := newRule(newTestRule("exit_block"))
+		require.NoError(t, err)
+		defer r.Close()
+
+		list := &testNode{Value: "go client"}
+		list.Next = &testNode{Value: "Arachni", Next: list}
+		self := map[string]interface{}{"value": "curl"}
+		self["self"] = self
+		shared := &testNode{Value: "shared"}
+
+		res, err := r.RunWithResult(types.DataSet{
+			"user-agent": []interface{}{list, self, shared, shared},
+		}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, res.Action)
+		// The shared values are not cycles and are encoded every time
+		require.Equal(t, types.EncodeStats{
+			Cycles: 2,
+			Events: []types.EncodeEvent{
+				{Issue: types.EncodeCycle, KeyPath: []string{"user-agent", "0", "Next", "Next"}},
+				{Issue: types.EncodeCycle, KeyPath: []string{"user-agent", "1", "self"}},
+			},
+		}, res.EncodeStats)
+		require.Equal(t, 12, res.EncodedValues)
+	})
+
+	t.Run("encodable", func(t *testing.T) {
+		t.Parallel()
+		r, _, err := newTestRuleWithConfig(newTestRule("exit_block"), types.Config{
+			MaxArrayLength: 4,
+			Engine:         config.Engine,
+		})
+		require.NoError(t, err)
+		defer r.Close()
+
+		var used error
+		res, err := r.RunWithResult(types.DataSet{
+			"user-agent": []interface{}{
+				testEncodeFunc(func(b types.WAFBuilder) error {
+					return b.Map(func(m types.WAFMapBuilder) error {
+						if err := m.Entry("password").String("<redacted>"); err != nil {
+							return err
+						}
+						return m.Entry("ua").Array(func(a types.WAFArrayBuilder) error {
+							for _, ua := range []string{"go client", "curl", "wget", "lynx", "Arachni"} {
+								if err := a.Append().Value(ua); err != nil {
+									return err
+								}
+							}
+							return nil
+						})
+					})
+				}),
+				testEncodeFunc(func(types.WAFBuilder) error { return errors.New("oops") }),
+				testEncodeFunc(func(b types.WAFBuilder) error {
+					var a types.WAFArrayBuilder
+					err := b.Array(func(arr types.WAFArrayBuilder) error {
+						a = arr
+						return arr.Append().Int(-1)
+					})
+					used = a.Append().Uint(1)
+					return err
+				}),
+			},
+		}, time.Second)
+		require.NoError(t, err)
+		// The payload is hidden beyond the array limit
+		require.Equal(t, types.NoAction, res.Action)
+		require.Equal(t, types.ErrWAFBuilderUsed, used)
+		require.Equal(t, types.EncodeStats{
+			DroppedArrayEntries: 1,
+			UnsupportedValues:   1,
+			Events: []types.EncodeEvent{
+				{Issue: types.EncodeDroppedArrayEntries, KeyPath: []string{"user-agent", "0", "ua"}},
+				{Issue: types.EncodeUnsupportedValue, KeyPath: []string{"user-agent", "1"}},
+			},
+		}, res.EncodeStats)
+
+		res, err = r.RunWithResult(types.DataSet{
+			"user-agent": testEncodeFunc(func(b types.WAFBuilder) error {
+				return b.Array(func(a types.WAFArrayBuilder) error {
+					return a.Append().Value("Arachni")
+				})
+			}),
+		}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, res.Action)
+		require.True(t, res.EncodeStats.Complete())
+
+		// Values encoding themselves are cycles
+		res, err = r.RunWithResult(types.DataSet{"user-agent": testRecursiveEncodable{}}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.NoAction, res.Action)
+		require.Equal(t, 1, res.EncodeStats.Cycles)
+		require.Equal(t, 0, res.EncodeStats.DepthCutoffs)
+	})
+
+	t.Run("close while running", func(t *testing.T) {
+		t.Parallel()
+		data := types.DataSet{"user-agent": "Arachni"}
+		for i := 0; i < 50; i++ {
+			r, err := newRule(newTestRule("exit_block"))
+			require.NoError(t, err)
+
+			// The runs in progress complete while the next ones fail
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						res, err := r.RunWithResult(data, time.Second)
+						if err == types.ErrRuleClosed {
+							return
+						}
+						if err != nil || res.Action != types.BlockAction {
+							t.Errorf("action=`%v` err=`%v`", res.Action, err)
+							return
+						}
+					}
+				}()
+			}
+			for g := 0; g < 2; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					time.Sleep(time.Millisecond)
+					if err := r.Close(); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			_, _, err = r.Run(data, time.Second)
+			require.Equal(t, types.ErrRuleClosed, err)
+			_, _, err = r.RunContext(context.Background(), data)
+			require.Equal(t, types.ErrRuleClosed, err)
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		t.Parallel()
+		r, err := newRule(newTestRule("exit_block"))
+		require.NoError(t, err)
+		defer r.Close()
+		wafCtx := waf.NewAdditiveContext(r)
+		require.NotNil(t, wafCtx)
+		defer wafCtx.Close()
+
+		for _, r := range []testRule{r, wafCtx.(testRule)} {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			action, match, err := r.RunContext(ctx, types.DataSet{"user-agent": "Arachni"})
+			cancel()
+			require.NoError(t, err)
+			require.Equal(t, types.BlockAction, action)
+			require.NotEmpty(t, match)
+
+			// Without deadline
+			action, match, err = r.RunContext(context.Background(), types.DataSet{"user-agent": "go client"})
+			require.NoError(t, err)
+			require.Equal(t, types.NoAction, action)
+			require.Empty(t, match)
+
+			// Canceled
+			ctx, cancel = context.WithCancel(context.Background())
+			cancel()
+			action, match, err = r.RunContext(ctx, types.DataSet{"user-agent": "Arachni"})
+			require.Equal(t, context.Canceled, err)
+			require.Equal(t, types.NoAction, action)
+			require.Empty(t, match)
+
+			// Deadline exceeded
+			ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+			action, match, err = r.RunContext(ctx, types.DataSet{"user-agent": "Arachni"})
+			cancel()
+			require.Equal(t, context.DeadlineExceeded, err)
+			require.Equal(t, types.NoAction, action)
+			require.Empty(t, match)
+		}
+	})
+
 	t.Run("timeout", func(t *testing.T) {
 		t.Parallel()
 		rule := newTestRule("exit_block")
-		r, err := waf.NewRule(rule)
+		r, err := newRule(rule)
 		require.NoError(t, err)
 		defer r.Close()
 
@@ -95,10 +557,308 @@ func TestUsage(t *testing.T) {
 		require.Empty(t, match)
 	})
 
+	t.Run("additive context lifecycle", func(t *testing.T) {
+		t.Parallel()
+		data := types.DataSet{"user-agent": "Arachni"}
+
+		// Values that are not rules of an engine
+		for _, r := range []types.Rule{nil, waf.NewManager(config)} {
+			ctx, err := waf.NewAdditiveContextWithError(r)
+			require.Equal(t, types.ErrIncompatibleRule, err)
+			require.Nil(t, ctx)
+		}
+
+		r, err := newRule(newTestRule("exit_block"))
+		require.NoError(t, err)
+		ctx, err := waf.NewAdditiveContextWithError(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+
+		// The context keeps running once the rule is closed, while new contexts
+		// can no longer be created from it
+		action, _, err := ctx.Run(data, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+		closed, err := waf.NewAdditiveContextWithError(r)
+		require.Equal(t, types.ErrRuleClosed, err)
+		require.Nil(t, closed)
+		require.Nil(t, waf.NewAdditiveContext(r))
+
+		require.NoError(t, ctx.Close())
+		require.NoError(t, ctx.Close())
+		_, _, err = ctx.Run(data, time.Second)
+		require.Equal(t, types.ErrContextClosed, err)
+		_, err = ctx.(testRule).RunWithResult(data, time.Second)
+		require.Equal(t, types.ErrContextClosed, err)
+		_, _, err = ctx.(testRule).RunContext(context.Background(), data)
+		require.Equal(t, types.ErrContextClosed, err)
+	})
+
+	t.Run("manager", func(t *testing.T) {
+		t.Parallel()
+		m := waf.NewManager(config)
+		defer m.Close()
+		require.Equal(t, uint64(0), m.Generation())
+
+		// No rule yet
+		_, _, err := m.Run(types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.Equal(t, types.ErrNoRule, err)
+		_, _, err = m.NewAdditiveContext()
+		require.Equal(t, types.ErrNoRule, err)
+
+		_, err = m.Update(newTestRule("exit_monitor"))
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), m.Generation())
+		action, match, err := m.Run(types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.MonitorAction, action)
+		requireArachniMatch(t, types.MonitorAction, match)
+
+		wafCtx, generation, err := m.NewAdditiveContext()
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), generation)
+		defer wafCtx.Close()
+
+		// Failing updates keep the current rule
+		_, err = m.Update(`{ oops`)
+		require.IsType(t, &types.InvalidRuleError{}, err)
+		require.Equal(t, uint64(1), m.Generation())
+
+		_, err = m.Update(newTestRule("exit_block"))
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), m.Generation())
+		action, _, err = m.Run(types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+
+		// The additive context still uses the first rule
+		action, _, err = wafCtx.Run(types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.MonitorAction, action)
+
+		require.NoError(t, m.Close())
+		_, _, err = m.Run(types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.Equal(t, types.ErrNoRule, err)
+		_, err = m.Update(newTestRule("exit_block"))
+		require.Equal(t, types.ErrRuleClosed, err)
+		require.Equal(t, uint64(2), m.Generation())
+		_, _, err = m.Run(types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.Equal(t, types.ErrNoRule, err)
+	})
+
+	t.Run("file loader", func(t *testing.T) {
+		t.Parallel()
+		dir, err := ioutil.TempDir("", "waf-loader")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "rule.json")
+
+		var (
+			rules  []types.Rule
+			errors []*waf.LoadError
+		)
+		defer func() {
+			for _, r := range rules {
+				r.Close()
+			}
+		}()
+		loader := waf.NewFileLoader(path, config, time.Hour, func(r types.Rule, _ types.Diagnostics) {
+			rules = append(rules, r)
+		}, func(err *waf.LoadError) {
+			errors = append(errors, err)
+		})
+		// writeFile writes the file and sets a new modification time so that
+		// the change gets detected.
+		modTime := time.Now()
+		writeFile := func(content string) {
+			require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+			modTime = modTime.Add(time.Second)
+			require.NoError(t, os.Chtimes(path, modTime, modTime))
+		}
+
+		// Missing file, reported once
+		require.False(t, loader.Poll())
+		require.Len(t, errors, 1)
+		require.True(t, os.IsNotExist(errors[0].Err))
+		require.False(t, loader.Poll())
+		require.Len(t, errors, 1)
+
+		writeFile(newTestRule("exit_monitor"))
+		require.True(t, loader.Poll())
+		require.Len(t, rules, 1)
+		action, _, err := rules[0].Run(types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.MonitorAction, action)
+
+		// Unchanged file
+		require.False(t, loader.Poll())
+		// Modified file with the same content
+		writeFile(newTestRule("exit_monitor"))
+		require.False(t, loader.Poll())
+		require.Len(t, rules, 1)
+
+		// Invalid rule
+		writeFile(`{ oops`)
+		require.False(t, loader.Poll())
+		require.Len(t, rules, 1)
+		require.Len(t, errors, 2)
+		require.Equal(t, path, errors[1].Path)
+		require.IsType(t, &types.InvalidRuleError{}, errors[1].Err)
+		require.Equal(t, errors[1].Err.(*types.InvalidRuleError).Diagnostics, errors[1].Diagnostics)
+		// Reported once
+		require.False(t, loader.Poll())
+		require.Len(t, errors, 2)
+
+		writeFile(newTestRule("exit_block"))
+		require.True(t, loader.Poll())
+		require.Len(t, rules, 2)
+		action, _, err = rules[1].Run(types.DataSet{"user-agent": "Arachni"}, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, types.BlockAction, action)
+
+		// Removed file, reported again once
+		require.NoError(t, os.Remove(path))
+		require.False(t, loader.Poll())
+		require.False(t, loader.Poll())
+		require.Len(t, errors, 3)
+		require.True(t, os.IsNotExist(errors[2].Err))
+		writeFile(newTestRule("exit_block"))
+		require.False(t, loader.Poll())
+		require.Len(t, rules, 2)
+
+		// Non-positive intervals fall back to the default one
+		for _, interval := range []time.Duration{0, -time.Second} {
+			loaded := make(chan types.Rule, 1)
+			loader := waf.NewFileLoader(path, config, interval, func(r types.Rule, _ types.Diagnostics) {
+				loaded <- r
+			}, nil)
+			loader.Start()
+			r := <-loaded
+			loader.Stop()
+			require.NoError(t, r.Close())
+		}
+
+		// Polling goroutine
+		loaded := make(chan types.Rule, 1)
+		loader = waf.NewFileLoader(path, config, time.Millisecond, func(r types.Rule, _ types.Diagnostics) {
+			loaded <- r
+		}, nil)
+		// Stopping a loader which was never started
+		loader.Stop()
+		loader.Start()
+		// Starting it again has no effect
+		loader.Start()
+		r := <-loaded
+		loader.Stop()
+		require.NoError(t, r.Close())
+		// Stopping it again has no effect
+		loader.Stop()
+
+		// Restarting it once stopped
+		writeFile(newTestRule("exit_monitor"))
+		loader.Start()
+		r = <-loaded
+		loader.Stop()
+		require.NoError(t, r.Close())
+		select {
+		case r := <-loaded:
+			r.Close()
+			t.Fatal("unexpected rule loaded after stopping the loader")
+		default:
+		}
+	})
+
+	t.Run("one manager - 5000 concurrent users and rule reloads", func(t *testing.T) {
+		t.Parallel()
+		m := waf.NewManager(config)
+		defer m.Close()
+		_, err := m.Update(newTestRule("exit_block"))
+		require.NoError(t, err)
+
+		userAgents := [...]string{"Arachni", "Toto", "Tata", "Titi"}
+		matchingUserAgentIndex := 0
+
+		// Start 5000 users that will use the rule 100 times each, while another
+		// goroutine keeps reloading the rule.
+		nbUsers := 5000
+		nbRun := 100
+
+		var startBarrier, stopBarrier sync.WaitGroup
+		startBarrier.Add(nbUsers + 1)
+		stopBarrier.Add(nbUsers)
+
+		done := make(chan struct{})
+		reloaded := make(chan uint64)
+		go func() {
+			startBarrier.Wait()
+			var nbReloads uint64
+			defer func() { reloaded <- nbReloads }()
+			actions := [...]string{"exit_monitor", "exit_block"}
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					if _, err := m.Update(newTestRule(actions[nbReloads%2])); err != nil {
+						t.Error(err)
+						return
+					}
+					nbReloads++
+				}
+			}
+		}()
+
+		for n := 0; n < nbUsers; n++ {
+			go func() {
+				startBarrier.Wait()      // Sync the starts of the goroutines
+				defer stopBarrier.Done() // Signal we are done when returning
+				for c := 0; c < nbRun; c++ {
+					i := c % len(userAgents)
+					data := types.DataSet{"user-agent": userAgents[i]}
+					var (
+						action types.Action
+						match  []byte
+						err    error
+					)
+					if c%10 == 0 {
+						// Regularly use additive contexts too
+						var wafCtx types.Rule
+						wafCtx, _, err = m.NewAdditiveContext()
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						action, match, err = wafCtx.Run(data, time.Minute)
+						wafCtx.Close()
+					} else {
+						action, match, err = m.Run(data, time.Minute)
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if i == matchingUserAgentIndex && (action == types.NoAction || len(match) == 0) {
+						t.Errorf("action=`%v` match=`%v`", action, string(match))
+						return
+					} else if i != matchingUserAgentIndex && (action != types.NoAction || len(match) > 0) {
+						t.Errorf("action=`%v` match=`%v`", action, string(match))
+						return
+					}
+				}
+			}()
+		}
+
+		startBarrier.Add(-(nbUsers + 1)) // Unblock the goroutines
+		stopBarrier.Wait()               // Wait for the user goroutines to be done
+		close(done)
+		nbReloads := <-reloaded
+		require.Equal(t, nbReloads+1, m.Generation())
+	})
+
 	t.Run("one rule - 8000 concurrent users", func(t *testing.T) {
 		t.Parallel()
 		rule := newTestRule("exit_block")
-		r, err := waf.NewRule(rule)
+		r, err := newRule(rule)
 		require.NoError(t, err)
 		defer r.Close()
 
@@ -124,12 +884,15 @@ func TestUsage(t *testing.T) {
 					i := c % len(userAgents)
 					action, match, err := r.Run(types.DataSet{"user-agent": userAgents[i]}, time.Minute)
 					if err != nil {
-						t.Fatal(err)
+						t.Error(err)
+						return
 					}
 					if i == blockingUserAgentIndex && (action != types.BlockAction || len(match) == 0) {
-						t.Fatalf("action=`%v` match=`%v`", action, string(match))
+						t.Errorf("action=`%v` match=`%v`", action, string(match))
+						return
 					} else if i != blockingUserAgentIndex && (action != types.NoAction || len(match) > 0) {
-						t.Fatalf("action=`%v` match=`%v`", action, string(match))
+						t.Errorf("action=`%v` match=`%v`", action, string(match))
+						return
 					}
 				}
 			}()
@@ -142,6 +905,22 @@ func TestUsage(t *testing.T) {
 	})
 }
 
+// requireArachniMatch checks the match report is the one of the test rule.
+func requireArachniMatch(t *testing.T, action types.Action, match []byte) {
+	events, err := waf.DecodeMatchEvents(match)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	event := events[0]
+	require.Equal(t, action, event.Action)
+	require.Equal(t, "1", event.RuleID)
+	require.Equal(t, "arachni_detection", event.FlowName)
+	require.Equal(t, "start", event.Step)
+	require.Equal(t, "@rx", event.Operator)
+	require.Equal(t, "Arachni", event.OperatorValue)
+	require.Equal(t, "user-agent", event.Address)
+	require.Equal(t, "Arachni", event.ResolvedValue)
+}
+
 var tmpl = template.Must(template.New("").Parse(`
 {
   "manifest": {
@@ -191,3 +970,16 @@ func newTestRule(onMatchAction string) string {
 	})
 	return str.String()
 }
+
+type testNode struct {
+	Value string
+	Next  *testNode `waf:",omitempty"`
+}
+
+type testEncodeFunc func(b types.WAFBuilder) error
+
+func (f testEncodeFunc) EncodeWAF(b types.WAFBuilder) error { return f(b) }
+
+type testRecursiveEncodable struct{}
+
+func (e testRecursiveEncodable) EncodeWAF(b types.WAFBuilder) error { return b.Value(e) }